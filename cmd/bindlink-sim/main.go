@@ -0,0 +1,217 @@
+// bindlink-sim runs a master and a slave over emulated links and reports how
+// traffic is spread over them.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Jille/bindlink/linkmap"
+	"github.com/Jille/bindlink/linkmap/memconn"
+	"github.com/Jille/bindlink/multiplexer"
+	"github.com/Jille/bindlink/tundev/memdev"
+)
+
+var (
+	scenarioFile = flag.String("scenario", "", "JSON file describing the links and traffic")
+	verbose      = flag.Bool("v", false, "Show bindlink's own logging")
+)
+
+type side struct {
+	dev *memdev.Device
+	mp  *multiplexer.Mux
+	lm  *linkmap.Map
+}
+
+func newSide() *side {
+	s := &side{
+		dev: memdev.New(10000),
+		mp:  multiplexer.New(),
+	}
+	s.lm = linkmap.New(s.mp)
+	return s
+}
+
+func (s *side) start() {
+	s.mp.Start(s.dev.Send, s.lm.Send)
+	go s.dev.Run(s.mp.Send)
+	go s.lm.Run()
+}
+
+// receiver collects statistics about packets coming out of one side.
+type receiver struct {
+	mtx        sync.Mutex
+	seen       map[uint64]bool
+	latencies  []time.Duration
+	bytes      int
+	duplicates int
+}
+
+func (r *receiver) run(ch <-chan []byte) {
+	for p := range ch {
+		seq := binary.BigEndian.Uint64(p)
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(p[8:])))
+		r.mtx.Lock()
+		if r.seen[seq] {
+			r.duplicates++
+		} else {
+			r.seen[seq] = true
+			r.bytes += len(p)
+			r.latencies = append(r.latencies, time.Since(sent))
+		}
+		r.mtx.Unlock()
+	}
+}
+
+// generate injects packets until stop is closed and returns how many.
+func generate(dev *memdev.Device, t Traffic, stop <-chan struct{}) int {
+	interval := time.Duration(int64(time.Second) * int64(t.PacketSize) / int64(t.Rate))
+	buf := make([]byte, t.PacketSize)
+	start := time.Now()
+	var seq uint64
+	for {
+		select {
+		case <-stop:
+			return int(seq)
+		default:
+		}
+		binary.BigEndian.PutUint64(buf, seq)
+		binary.BigEndian.PutUint64(buf[8:], uint64(time.Now().UnixNano()))
+		dev.Inject(buf)
+		seq++
+		if d := time.Until(start.Add(time.Duration(seq) * interval)); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func main() {
+	flag.Parse()
+	if *scenarioFile == "" {
+		log.Fatalf("--scenario is required")
+	}
+	sc, err := loadScenario(*scenarioFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	master, slave := newSide(), newSide()
+	listener := memconn.NewListener(4000, sc.Seed)
+	master.lm.Listen(listener)
+	conns := make([]*memconn.Conn, len(sc.Links))
+	for i, l := range sc.Links {
+		conns[i] = listener.Dial(l.Up.config(), l.Down.config())
+		slave.lm.AddLink(conns[i])
+	}
+	master.start()
+	slave.start()
+
+	logger.Printf("Warming up for %s", time.Duration(sc.Warmup))
+	time.Sleep(time.Duration(sc.Warmup))
+	warmupUp, warmupDown := make([]memconn.PipeStats, len(conns)), make([]memconn.PipeStats, len(conns))
+	for i, c := range conns {
+		warmupUp[i], warmupDown[i] = c.Stats()
+	}
+
+	for i, l := range sc.Links {
+		c, base := conns[i], l
+		for _, ev := range l.Events {
+			ev := ev
+			up, down := base.Up.config(), base.Down.config()
+			if ev.Up != nil {
+				up = ev.Up.config()
+			}
+			if ev.Down != nil {
+				down = ev.Down.config()
+			}
+			if ev.Outage {
+				up.Loss = 1
+				down.Loss = 1
+			}
+			time.AfterFunc(time.Duration(ev.At), func() {
+				logger.Printf("%s: event starts", base.Name)
+				c.SetConfig(up, down)
+			})
+			time.AfterFunc(time.Duration(ev.At+ev.Duration), func() {
+				logger.Printf("%s: event ends", base.Name)
+				c.SetConfig(base.Up.config(), base.Down.config())
+			})
+		}
+	}
+
+	type direction struct {
+		name string
+		from *side
+		to   *side
+		recv *receiver
+		sent int
+	}
+	var dirs []*direction
+	if sc.Traffic.Direction != "down" {
+		dirs = append(dirs, &direction{name: "up", from: slave, to: master})
+	}
+	if sc.Traffic.Direction != "up" {
+		dirs = append(dirs, &direction{name: "down", from: master, to: slave})
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, d := range dirs {
+		d := d
+		d.recv = &receiver{seen: map[uint64]bool{}}
+		go d.recv.run(d.to.dev.Received())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.sent = generate(d.from.dev, sc.Traffic, stop)
+		}()
+	}
+	logger.Printf("Running scenario for %s", time.Duration(sc.Duration))
+	time.Sleep(time.Duration(sc.Duration))
+	close(stop)
+	wg.Wait()
+	// Give packets in flight a chance to arrive.
+	time.Sleep(time.Second)
+
+	secs := time.Duration(sc.Duration).Seconds()
+	for _, d := range dirs {
+		d.recv.mtx.Lock()
+		lat := append([]time.Duration(nil), d.recv.latencies...)
+		sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+		fmt.Printf("%s: sent %d packets, received %d unique (%.1f%%), %d duplicates\n", d.name, d.sent, len(d.recv.seen), 100*float64(len(d.recv.seen))/float64(d.sent), d.recv.duplicates)
+		fmt.Printf("%s: goodput %.1f kbit/s of %.1f kbit/s offered\n", d.name, float64(d.recv.bytes)*8/1000/secs, float64(sc.Traffic.Rate)*8/1000)
+		fmt.Printf("%s: latency p50 %s p90 %s p99 %s max %s\n", d.name, percentile(lat, 0.5), percentile(lat, 0.9), percentile(lat, 0.99), percentile(lat, 1))
+		d.recv.mtx.Unlock()
+	}
+	for i, l := range sc.Links {
+		up, down := conns[i].Stats()
+		report := func(name string, s, warmup memconn.PipeStats, d Direction) {
+			offered := s.Bytes - warmup.Bytes
+			delivered := s.Delivered - warmup.Delivered
+			util := "unlimited"
+			if d.Bandwidth > 0 {
+				util = fmt.Sprintf("%.1f%%", 100*float64(delivered)/secs/float64(d.Bandwidth))
+			}
+			fmt.Printf("link %s %s: %d packets, offered %.1f kbit/s, delivered %.1f kbit/s, utilisation %s, %d dropped\n", l.Name, name, s.Packets-warmup.Packets, float64(offered)*8/1000/secs, float64(delivered)*8/1000/secs, util, s.Dropped-warmup.Dropped)
+		}
+		report("up", up, warmupUp[i], l.Up)
+		report("down", down, warmupDown[i], l.Down)
+	}
+}
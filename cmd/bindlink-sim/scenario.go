@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Jille/bindlink/linkmap/memconn"
+)
+
+// duration is a time.Duration that is written as "1.5s" in scenario files.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+type Scenario struct {
+	// Duration of the measurement, after Warmup.
+	Duration duration `json:"duration"`
+	// Warmup lets the links exchange control packets before measuring.
+	Warmup  duration `json:"warmup"`
+	Seed    int64    `json:"seed"`
+	Traffic Traffic  `json:"traffic"`
+	Links   []Link   `json:"links"`
+}
+
+type Traffic struct {
+	// Direction is "up" (slave to master), "down" or "both".
+	Direction string `json:"direction"`
+	// Rate in bytes per second per direction.
+	Rate       int `json:"rate"`
+	PacketSize int `json:"packet_size"`
+}
+
+type Link struct {
+	Name   string      `json:"name"`
+	Up     Direction   `json:"up"`
+	Down   Direction   `json:"down"`
+	Events []LinkEvent `json:"events"`
+}
+
+type Direction struct {
+	Delay     duration `json:"delay"`
+	Jitter    duration `json:"jitter"`
+	Loss      float64  `json:"loss"`
+	Reorder   float64  `json:"reorder"`
+	Bandwidth int      `json:"bandwidth"`
+	Buffer    duration `json:"buffer"`
+}
+
+// LinkEvent changes a link for a while, starting At after the warmup.
+type LinkEvent struct {
+	At       duration `json:"at"`
+	Duration duration `json:"duration"`
+	// Outage drops all packets in both directions.
+	Outage bool       `json:"outage"`
+	Up     *Direction `json:"up"`
+	Down   *Direction `json:"down"`
+}
+
+func (d Direction) config() memconn.Config {
+	return memconn.Config{
+		Delay:     time.Duration(d.Delay),
+		Jitter:    time.Duration(d.Jitter),
+		Loss:      d.Loss,
+		Reorder:   d.Reorder,
+		Bandwidth: d.Bandwidth,
+		Buffer:    time.Duration(d.Buffer),
+	}
+}
+
+func loadScenario(fn string) (*Scenario, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &Scenario{
+		Duration: duration(30 * time.Second),
+		Warmup:   duration(3 * time.Second),
+		Seed:     1,
+		Traffic: Traffic{
+			Direction:  "up",
+			Rate:       1000000,
+			PacketSize: 1200,
+		},
+	}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", fn, err)
+	}
+	switch s.Traffic.Direction {
+	case "up", "down", "both":
+	default:
+		return nil, fmt.Errorf("traffic.direction should be up, down or both, not %q", s.Traffic.Direction)
+	}
+	if s.Traffic.Rate <= 0 {
+		return nil, fmt.Errorf("traffic.rate should be positive")
+	}
+	if s.Traffic.PacketSize < 16 {
+		return nil, fmt.Errorf("traffic.packet_size should be at least 16")
+	}
+	if len(s.Links) == 0 {
+		return nil, fmt.Errorf("scenario has no links")
+	}
+	return s, nil
+}
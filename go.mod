@@ -1,9 +1,26 @@
 module github.com/Jille/bindlink
 
-go 1.13
+go 1.26.3
 
 require (
-	github.com/prometheus/client_golang v1.3.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/prometheus/client_golang v1.13.0
 	github.com/songgao/water v0.0.0-20190725173103-fd331bda3f4b
-	golang.org/x/sys v0.0.0-20191228213918-04cbcbbfeed8 // indirect
+	golang.org/x/net v0.52.0
+	golang.org/x/sys v0.43.0
+	gvisor.dev/gvisor v0.0.0-20260527191743-a81fd9dd382e
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/golang/protobuf v1.5.4 // indirect
+	github.com/google/btree v1.1.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.2 // indirect
+	github.com/prometheus/client_model v0.6.2 // indirect
+	github.com/prometheus/common v0.38.0 // indirect
+	github.com/prometheus/procfs v0.16.0 // indirect
+	golang.org/x/exp v0.0.0-20250711185948-6ae5c78190dc // indirect
+	golang.org/x/time v0.15.0 // indirect
+	google.golang.org/protobuf v1.36.11 // indirect
 )
@@ -0,0 +1,299 @@
+package linkmap
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/Jille/bindlink/packet"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// batchSize is the most packets we read or write with one syscall.
+	batchSize = 64
+	// groBatchSize is batchSize with GRO, which reads up to 64KiB each.
+	groBatchSize = 8
+	// readBufferSize is the largest packet we read without GRO.
+	readBufferSize = 8192
+	// maxDatagramSize is the most GRO coalesces into one read.
+	maxDatagramSize = 65535
+	// maxGSOSegments and maxGSOSize are the kernel's limits on a GSO write.
+	maxGSOSegments = 64
+	maxGSOSize     = 65000
+)
+
+// batchReader can read several packets per syscall. b is only valid during
+// handle.
+type batchReader interface {
+	ReadBatch(handle func(b []byte, addr *net.UDPAddr)) error
+}
+
+// messageConn is the batch API of ipv4.PacketConn and ipv6.PacketConn.
+type messageConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// batchConn is a UDP socket that reads and writes many packets per syscall,
+// with GRO and GSO if possible. Writes are queued for a writer goroutine.
+type batchConn struct {
+	*net.UDPConn
+	mc  messageConn
+	gro bool
+	// gso is cleared if the kernel rejects segmented writes.
+	gso atomic.Bool
+
+	// rms holds the buffers of the reader.
+	rms []ipv4.Message
+
+	queue     chan outPacket
+	done      chan struct{}
+	closeOnce sync.Once
+	// werr is the writer's last error, returned by the next write.
+	werr atomic.Pointer[error]
+
+	// The rest is only used by the writer.
+	wms   []ipv4.Message
+	wbufs [][]byte
+	woob  [][]byte
+	// wstart maps every message in wms to the packet it starts with.
+	wstart []int
+	// wgso holds the packets merged for GSO.
+	wgso []byte
+}
+
+type outPacket struct {
+	buf *packet.Buffer
+	// data is taken when queued, as the headers of buf may change after.
+	data []byte
+	// addr is nil on connected sockets.
+	addr *net.UDPAddr
+}
+
+func newBatchConn(c *net.UDPConn) *batchConn {
+	bc := &batchConn{
+		UDPConn: c,
+		queue:   make(chan outPacket, 1024),
+		done:    make(chan struct{}),
+		wms:     make([]ipv4.Message, 0, batchSize),
+		wbufs:   make([][]byte, batchSize),
+		woob:    make([][]byte, batchSize),
+		wstart:  make([]int, 0, batchSize),
+	}
+	if a, ok := c.LocalAddr().(*net.UDPAddr); ok && a.IP.To4() != nil {
+		bc.mc = ipv4.NewPacketConn(c)
+	} else {
+		bc.mc = ipv6.NewPacketConn(c)
+	}
+	gso, gro := enableUDPOffload(c)
+	bc.gso.Store(gso)
+	bc.gro = gro
+	for i := range bc.woob {
+		bc.woob[i] = make([]byte, 0, 32)
+	}
+	go bc.writeLoop()
+	return bc
+}
+
+// ReadBatch reads up to a batch of packets, splitting GRO coalesced ones.
+func (c *batchConn) ReadBatch(handle func(b []byte, addr *net.UDPAddr)) error {
+	if c.rms == nil {
+		// Write-only sockets don't need them.
+		n, size := batchSize, readBufferSize
+		if c.gro {
+			n, size = groBatchSize, maxDatagramSize
+		}
+		c.rms = make([]ipv4.Message, n)
+		for i := range c.rms {
+			c.rms[i].Buffers = [][]byte{make([]byte, size)}
+			if c.gro {
+				c.rms[i].OOB = make([]byte, 64)
+			}
+		}
+	}
+	n, err := c.mc.ReadBatch(c.rms, 0)
+	if err != nil {
+		return err
+	}
+	for i := range c.rms[:n] {
+		m := &c.rms[i]
+		addr, _ := m.Addr.(*net.UDPAddr)
+		b := m.Buffers[0][:m.N]
+		segment := len(b)
+		if c.gro {
+			if s := groSegmentSize(m.OOB[:m.NN]); s > 0 {
+				segment = s
+			}
+		}
+		for len(b) > 0 {
+			l := segment
+			if l > len(b) {
+				l = len(b)
+			}
+			handle(b[:l], addr)
+			b = b[l:]
+		}
+	}
+	return nil
+}
+
+func (c *batchConn) Write(b []byte) (int, error) {
+	return c.WriteToUDP(b, nil)
+}
+
+// WriteToUDP queues a copy of b. addr must be nil for connected sockets.
+func (c *batchConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if err := c.enqueue(packet.FromBytes(b), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WriteBuffer queues p without copying it. It takes a reference.
+func (c *batchConn) WriteBuffer(p *packet.Buffer, addr *net.UDPAddr) error {
+	p.Retain()
+	return c.enqueue(p, addr)
+}
+
+// enqueue takes over the caller's reference to p. It drops p if the queue is
+// full.
+func (c *batchConn) enqueue(p *packet.Buffer, addr *net.UDPAddr) error {
+	select {
+	case <-c.done:
+		p.Release()
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case c.queue <- outPacket{buf: p, data: p.Bytes(), addr: addr}:
+	default:
+		p.Release()
+		return syscall.ENOBUFS
+	}
+	// p is on its way, but an earlier packet failed.
+	if err := c.werr.Swap(nil); err != nil {
+		return *err
+	}
+	return nil
+}
+
+func (c *batchConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.UDPConn.Close()
+}
+
+func (c *batchConn) writeLoop() {
+	batch := make([]outPacket, 0, batchSize)
+	for {
+		select {
+		case p := <-c.queue:
+			batch = append(batch[:0], p)
+		case <-c.done:
+			return
+		}
+	drain:
+		for len(batch) < batchSize {
+			select {
+			case p := <-c.queue:
+				batch = append(batch, p)
+			default:
+				break drain
+			}
+		}
+		c.writeBatch(batch)
+		for i, p := range batch {
+			p.buf.Release()
+			batch[i] = outPacket{}
+		}
+	}
+}
+
+// writeBatch sends batch with as few syscalls as possible, using GSO if we can.
+func (c *batchConn) writeBatch(batch []outPacket) {
+	gso := c.gso.Load()
+	if gso {
+		// Merged runs mustn't move when wgso grows.
+		need := 0
+		for _, p := range batch {
+			need += len(p.data)
+		}
+		if cap(c.wgso) < need {
+			c.wgso = make([]byte, 0, need)
+		}
+	}
+	merged := c.wgso[:0]
+	ms, starts := c.wms[:0], c.wstart[:0]
+	for i := 0; i < len(batch); {
+		p := batch[i]
+		j := i + 1
+		if gso {
+			j = gsoRun(batch, i)
+		}
+		k := len(ms)
+		c.wbufs[k] = p.data
+		m := ipv4.Message{Buffers: c.wbufs[k : k+1]}
+		if p.addr != nil {
+			m.Addr = p.addr
+		}
+		if j-i > 1 {
+			from := len(merged)
+			for _, q := range batch[i:j] {
+				merged = append(merged, q.data...)
+			}
+			c.wbufs[k] = merged[from:]
+			m.OOB = gsoControl(c.woob[k], len(p.data))
+		}
+		ms = append(ms, m)
+		starts = append(starts, i)
+		i = j
+	}
+	for len(ms) > 0 {
+		n, err := c.mc.WriteBatch(ms, 0)
+		if err == nil {
+			ms, starts = ms[n:], starts[n:]
+			continue
+		}
+		if len(ms[0].OOB) > 0 && gsoUnsupported(err) {
+			log.Printf("UDP GSO doesn't work on %s, sending packets one by one: %v", c.LocalAddr(), err)
+			c.gso.Store(false)
+			c.writeBatch(batch[starts[0]:])
+			return
+		}
+		// Skip the packet that failed and report the error with the next write.
+		werr := err
+		c.werr.Store(&werr)
+		ms, starts = ms[1:], starts[1:]
+	}
+}
+
+// gsoRun returns the end of the run from i that fits in one GSO message: same
+// address and size, except for a shorter last one.
+func gsoRun(batch []outPacket, i int) int {
+	size := len(batch[i].data)
+	total := size
+	j := i + 1
+	for ; j < len(batch) && j-i < maxGSOSegments; j++ {
+		l := len(batch[j].data)
+		if l > size || total+l > maxGSOSize || !sameDestination(batch[i].addr, batch[j].addr) {
+			break
+		}
+		total += l
+		if l < size {
+			return j + 1
+		}
+	}
+	return j
+}
+
+func sameDestination(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return sameUDPAddr(a, b)
+}
@@ -0,0 +1,299 @@
+package linkmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jille/bindlink/multiplexer"
+	"github.com/Jille/bindlink/packet"
+)
+
+const benchPacketSize = 1400
+
+// udpSink returns the address of a socket that drops everything.
+func udpSink(tb testing.TB) *net.UDPAddr {
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { sock.Close() })
+	go drain(sock)
+	return sock.LocalAddr().(*net.UDPAddr)
+}
+
+// drain reads from sock until it's closed, without allocating.
+func drain(sock *net.UDPConn) {
+	buf := make([]byte, 65536)
+	for {
+		if _, err := sock.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+func newBenchMap(tb testing.TB) (*Map, *multiplexer.Mux) {
+	mp := multiplexer.New()
+	lm := New(mp)
+	mp.Start(func([]byte) error { return nil }, lm.Send)
+	tb.Cleanup(func() {
+		for id := 1; id < maxLinks; id++ {
+			lm.RemoveLink(id)
+		}
+	})
+	return lm, mp
+}
+
+// sendPacket gets a packet from the pool and sends it with send.
+func sendPacket(send func(p *packet.Buffer) error) error {
+	p := packet.Get(benchPacketSize)
+	defer p.Release()
+	return send(p)
+}
+
+func benchmarkSend(b *testing.B, send func(p *packet.Buffer) error) {
+	b.ReportAllocs()
+	b.SetBytes(benchPacketSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := sendPacket(send); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func sendUDP(tb testing.TB) func(p *packet.Buffer) error {
+	lm, _ := newBenchMap(tb)
+	if err := lm.InitiateLink(udpSink(tb).String()); err != nil {
+		tb.Fatal(err)
+	}
+	return func(p *packet.Buffer) error {
+		return lm.Send(1, p)
+	}
+}
+
+func sendMux(tb testing.TB) func(p *packet.Buffer) error {
+	lm, mp := newBenchMap(tb)
+	sink := udpSink(tb).String()
+	for i := 0; i < 4; i++ {
+		if err := lm.InitiateLink(sink); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return mp.Send
+}
+
+func sendSOCKS(tb testing.TB) func(p *packet.Buffer) error {
+	lm, _ := newBenchMap(tb)
+	s := newFakeSOCKS(tb, "", "")
+	go drain(s.relay)
+	u, err := NewUDPOverSocks(s.proxy(), udpSink(tb).String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	lm.AddLink(u)
+	waitForState(tb, u, LinkUp)
+	return func(p *packet.Buffer) error {
+		return lm.Send(1, p)
+	}
+}
+
+func BenchmarkSendUDP(b *testing.B) {
+	benchmarkSend(b, sendUDP(b))
+}
+
+func BenchmarkSendMux(b *testing.B) {
+	benchmarkSend(b, sendMux(b))
+}
+
+func BenchmarkSendSOCKS(b *testing.B) {
+	benchmarkSend(b, sendSOCKS(b))
+}
+
+// sendWarmup is more packets than a batchConn queues. The pool grows to about
+// that many buffers while the queue fills up, after that sending shouldn't
+// allocate.
+const sendWarmup = 4096
+
+func TestSendDoesNotAllocate(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	for name, setup := range map[string]func(testing.TB) func(*packet.Buffer) error{
+		"UDP":   sendUDP,
+		"Mux":   sendMux,
+		"SOCKS": sendSOCKS,
+	} {
+		t.Run(name, func(t *testing.T) {
+			send := setup(t)
+			for i := 0; i < sendWarmup; i++ {
+				if err := sendPacket(send); err != nil {
+					t.Fatal(err)
+				}
+			}
+			allocs := testing.AllocsPerRun(sendWarmup, func() {
+				if err := sendPacket(send); err != nil {
+					t.Fatal(err)
+				}
+			})
+			if allocs != 0 {
+				t.Errorf("sending a packet took %v allocations, want 0", allocs)
+			}
+		})
+	}
+}
+
+func BenchmarkThroughput(b *testing.B) {
+	for _, links := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("links=%d", links), func(b *testing.B) {
+			benchmarkThroughput(b, links)
+		})
+	}
+}
+
+// inFlightPerLink limits the packets on their way over a link, so we don't
+// measure dropping.
+const inFlightPerLink = 32
+
+// benchFlow is the flow control of one link in benchmarkThroughput. Packets
+// carry a sequence number, so the sender knows how many are on their way.
+type benchFlow struct {
+	sent atomic.Int64
+	// acked is the highest sequence number the master received.
+	acked atomic.Int64
+	// room is signalled when a packet arrived.
+	room chan struct{}
+}
+
+// receive acks seq.
+func (f *benchFlow) receive(seq int64) {
+	for {
+		a := f.acked.Load()
+		if seq <= a || f.acked.CompareAndSwap(a, seq) {
+			break
+		}
+	}
+	select {
+	case f.room <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks while too many packets are on their way. Packets that don't
+// arrive in time are given up on, the benchmark counts them as lost at the end.
+func (f *benchFlow) wait() {
+	for {
+		sent := f.sent.Load()
+		if sent-f.acked.Load() < inFlightPerLink {
+			return
+		}
+		select {
+		case <-f.room:
+		case <-time.After(20 * time.Millisecond):
+			f.receive(sent)
+		}
+	}
+}
+
+// benchmarkThroughput sends b.N packets to a master over links loopback links,
+// with a sender per link.
+func benchmarkThroughput(b *testing.B, links int) {
+	flows := make([]benchFlow, links+1)
+	for i := range flows {
+		flows[i].room = make(chan struct{}, 1)
+	}
+	var received atomic.Int64
+	master := multiplexer.New()
+	mlm := New(master)
+	master.Start(func(p []byte) error {
+		// Senders put their link id and sequence number up front.
+		flows[p[0]].receive(int64(binary.LittleEndian.Uint64(p[1:])))
+		received.Add(1)
+		return nil
+	}, mlm.Send)
+	port := freeUDPPort(b)
+	if err := mlm.StartListener(port); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		mlm.StopListening()
+		for id := 1; id < maxLinks; id++ {
+			mlm.RemoveLink(id)
+		}
+	})
+
+	slm, _ := newBenchMap(b)
+	for i := 0; i < links; i++ {
+		if err := slm.InitiateLink(fmt.Sprintf("127.0.0.1:%d", port)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	send := func(id int, seq int64) {
+		p := packet.Get(benchPacketSize)
+		p.Bytes()[0] = byte(id)
+		binary.LittleEndian.PutUint64(p.Bytes()[1:], uint64(seq))
+		slm.Send(id, p)
+		p.Release()
+	}
+	// Don't measure setting up the links.
+	deadline := time.Now().Add(5 * time.Second)
+	for id := 1; id <= links; id++ {
+		for flows[id].acked.Load() == 0 {
+			if time.Now().After(deadline) {
+				b.Fatalf("master didn't hear from link %d", id)
+			}
+			send(id, 1)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	before := received.Load()
+	for i := range flows {
+		flows[i].sent.Store(0)
+		flows[i].acked.Store(0)
+	}
+
+	b.SetBytes(benchPacketSize)
+	b.ResetTimer()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for id := 1; id <= links; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			f := &flows[id]
+			for i := id - 1; i < b.N; i += links {
+				f.wait()
+				send(id, f.sent.Add(1))
+			}
+		}(id)
+	}
+	wg.Wait()
+	// Wait for the packets that are still on their way.
+	end := time.Now()
+	for n := received.Load(); n-before < int64(b.N); {
+		time.Sleep(10 * time.Millisecond)
+		m := received.Load()
+		if m == n {
+			break
+		}
+		n, end = m, time.Now()
+	}
+	b.StopTimer()
+	got := received.Load() - before
+	b.ReportMetric(float64(got)/end.Sub(start).Seconds(), "rx-packets/s")
+	b.ReportMetric(100*float64(got)/float64(b.N), "%received")
+}
+
+// freeUDPPort returns a port that was free on loopback a moment ago.
+func freeUDPPort(tb testing.TB) int {
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer sock.Close()
+	return sock.LocalAddr().(*net.UDPAddr).Port
+}
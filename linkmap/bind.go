@@ -0,0 +1,128 @@
+package linkmap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// linkOptions are the per-link settings that can follow a target.
+type linkOptions struct {
+	// source is the local address to send from.
+	source net.IP
+	// device binds the socket to a network interface with SO_BINDTODEVICE.
+	device string
+	// mark sets SO_MARK, for policy routing with ip rule fwmark.
+	mark int
+	// keepalive replaces control packets with minimal ones after this idle
+	// time.
+	keepalive time.Duration
+	// keepaliveAuto picks the keepalive interval from the probed NAT timeout.
+	keepaliveAuto bool
+}
+
+// splitLinkOptions parses
+// "target;src=1.2.3.4;dev=wwan0;mark=0x10;keepalive=auto".
+func splitLinkOptions(s string) (string, linkOptions, error) {
+	parts := strings.Split(s, ";")
+	var o linkOptions
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return "", o, fmt.Errorf("link option %q should be key=value", p)
+		}
+		switch kv[0] {
+		case "src":
+			o.source = net.ParseIP(kv[1])
+			if o.source == nil {
+				return "", o, fmt.Errorf("bad source address %q", kv[1])
+			}
+		case "dev":
+			o.device = kv[1]
+		case "mark":
+			m, err := strconv.ParseUint(kv[1], 0, 32)
+			if err != nil {
+				return "", o, fmt.Errorf("bad mark %q: %v", kv[1], err)
+			}
+			o.mark = int(m)
+		case "keepalive":
+			if kv[1] == "auto" {
+				o.keepaliveAuto = true
+				break
+			}
+			d, err := time.ParseDuration(kv[1])
+			if err != nil || d < time.Second {
+				return "", o, fmt.Errorf("keepalive should be auto or a duration of at least 1s, got %q", kv[1])
+			}
+			o.keepalive = d
+		default:
+			return "", o, fmt.Errorf("unknown link option %q", kv[0])
+		}
+	}
+	return parts[0], o, nil
+}
+
+func (o linkOptions) String() string {
+	var parts []string
+	if o.source != nil {
+		parts = append(parts, "src="+o.source.String())
+	}
+	if o.device != "" {
+		parts = append(parts, "dev="+o.device)
+	}
+	if o.mark != 0 {
+		parts = append(parts, fmt.Sprintf("mark=%#x", o.mark))
+	}
+	if o.keepaliveAuto {
+		parts = append(parts, "keepalive=auto")
+	} else if o.keepalive != 0 {
+		parts = append(parts, "keepalive="+o.keepalive.String())
+	}
+	return strings.Join(parts, ";")
+}
+
+func (o linkOptions) listenConfig() *net.ListenConfig {
+	return &net.ListenConfig{Control: o.control}
+}
+
+// listenUDP opens an unconnected UDP socket bound according to o.
+func (o linkOptions) listenUDP() (*net.UDPConn, error) {
+	addr := ":0"
+	if o.source != nil {
+		addr = net.JoinHostPort(o.source.String(), "0")
+	}
+	c, err := o.listenConfig().ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// dialUDP connects a UDP socket bound according to o to addr.
+func (o linkOptions) dialUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	d := &net.Dialer{Control: o.control}
+	if o.source != nil {
+		d.LocalAddr = &net.UDPAddr{IP: o.source}
+	}
+	c, err := d.Dial("udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// tcpDialer returns a dialer for stream links bound according to o.
+func (o linkOptions) tcpDialer() *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 4 * time.Second,
+		Control:   o.control,
+	}
+	if o.source != nil {
+		d.LocalAddr = &net.TCPAddr{IP: o.source}
+	}
+	return d
+}
@@ -0,0 +1,29 @@
+package linkmap
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func (o linkOptions) control(network, address string, c syscall.RawConn) error {
+	if o.device == "" && o.mark == 0 {
+		return nil
+	}
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		if o.device != "" {
+			if err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, o.device); err != nil {
+				serr = fmt.Errorf("SO_BINDTODEVICE %q: %v", o.device, err)
+				return
+			}
+		}
+		if o.mark != 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, o.mark); err != nil {
+				serr = fmt.Errorf("SO_MARK %#x: %v", o.mark, err)
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	return serr
+}
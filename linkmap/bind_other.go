@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package linkmap
+
+import (
+	"errors"
+	"syscall"
+)
+
+func (o linkOptions) control(network, address string, c syscall.RawConn) error {
+	if o.device != "" || o.mark != 0 {
+		return errors.New("binding links to a device or setting a mark is only supported on Linux")
+	}
+	return nil
+}
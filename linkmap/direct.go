@@ -0,0 +1,229 @@
+package linkmap
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Jille/bindlink/packet"
+)
+
+const (
+	// maxSocketFailures in a row make us replace the socket.
+	maxSocketFailures = 3
+	maxRebuildBackoff = 30 * time.Second
+)
+
+// udpSock is a connected batchConn or a resolvingConn.
+type udpSock interface {
+	UDPLikeConn
+	batchReader
+	bufferWriter
+	Close() error
+}
+
+// directConn is a direct UDP link. Its socket is replaced when it keeps
+// failing, e.g. because the local address went away.
+type directConn struct {
+	target string
+	opts   linkOptions
+	// failures counts errors in a row. Access it atomically.
+	failures int32
+
+	// sock is read without locking, and only replaced with mtx held.
+	sock atomic.Pointer[udpSock]
+	// closed is only set with mtx held.
+	closed atomic.Bool
+
+	mtx sync.Mutex
+	// rebuilding is set while a goroutine is replacing sock.
+	rebuilding bool
+	// lastRebuild is when sock was last replaced.
+	lastRebuild time.Time
+	// rebuilds is only used by the rebuilding goroutine.
+	rebuilds backoff
+}
+
+// dialDirect opens a direct link to target, a host:port.
+func dialDirect(target string, opts linkOptions) (*directConn, *net.UDPAddr, error) {
+	sock, addr, err := dialUDPSock(target, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &directConn{
+		target:   target,
+		opts:     opts,
+		rebuilds: backoff{min: time.Second, max: maxRebuildBackoff},
+	}
+	c.sock.Store(&sock)
+	return c, addr, nil
+}
+
+func dialUDPSock(target string, opts linkOptions) (udpSock, *net.UDPAddr, error) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	if net.ParseIP(host) == nil {
+		sock, err := dialResolving(target, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sock, sock.addr.Load(), nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, nil, err
+	}
+	sock, err := opts.dialUDP(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newBatchConn(sock), addr, nil
+}
+
+func (c *directConn) current() (udpSock, bool) {
+	return *c.sock.Load(), c.closed.Load()
+}
+
+func (c *directConn) Write(b []byte) (int, error) {
+	sock, _ := c.current()
+	n, err := sock.Write(b)
+	c.wrote(sock, err)
+	return n, err
+}
+
+func (c *directConn) WriteBuffer(p *packet.Buffer, _ *net.UDPAddr) error {
+	sock, _ := c.current()
+	err := sock.WriteBuffer(p, nil)
+	c.wrote(sock, err)
+	return err
+}
+
+// wrote keeps track of failing writes.
+func (c *directConn) wrote(sock udpSock, err error) {
+	if err != nil {
+		c.failed(sock, err)
+	} else if atomic.LoadInt32(&c.failures) != 0 {
+		atomic.StoreInt32(&c.failures, 0)
+	}
+}
+
+func (c *directConn) ReadFromUDP(b []byte) (n int, addr *net.UDPAddr, err error) {
+	err = c.read(func(sock udpSock) error {
+		var err error
+		n, addr, err = sock.ReadFromUDP(b)
+		return err
+	})
+	return n, addr, err
+}
+
+func (c *directConn) ReadBatch(handle func(b []byte, addr *net.UDPAddr)) error {
+	return c.read(func(sock udpSock) error {
+		return sock.ReadBatch(handle)
+	})
+}
+
+// read reads from the current socket with f, following replacements.
+func (c *directConn) read(f func(sock udpSock) error) error {
+	b := backoff{min: 10 * time.Millisecond, max: time.Second}
+	for {
+		sock, closed := c.current()
+		if closed {
+			return net.ErrClosed
+		}
+		err := f(sock)
+		if err == nil {
+			return nil
+		}
+		if cur, closed := c.current(); closed {
+			return net.ErrClosed
+		} else if cur != sock {
+			// The socket was replaced under us.
+			continue
+		}
+		if transientSocketError(err) {
+			return err
+		}
+		log.Printf("Link to %s: reading failed: %v", c.target, err)
+		c.failed(sock, err)
+		b.wait()
+	}
+}
+
+// transientSocketError returns whether err isn't fixed by a new socket.
+func transientSocketError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOBUFS)
+}
+
+// failed records an error on sock and replaces it if needed.
+func (c *directConn) failed(sock udpSock, err error) {
+	if transientSocketError(err) {
+		return
+	}
+	if atomic.AddInt32(&c.failures, 1) < maxSocketFailures {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.rebuilding || c.closed.Load() || *c.sock.Load() != sock {
+		return
+	}
+	log.Printf("Link to %s: socket keeps failing (%v), creating a new one", c.target, err)
+	c.rebuilding = true
+	go c.rebuild()
+}
+
+// rebuild creates a new socket and swaps it in, backing off as needed.
+func (c *directConn) rebuild() {
+	c.mtx.Lock()
+	recent := !c.lastRebuild.IsZero() && time.Since(c.lastRebuild) < 10*maxRebuildBackoff
+	c.mtx.Unlock()
+	if !recent {
+		c.rebuilds.reset()
+	} else if !c.rebuildWait() {
+		return
+	}
+	for {
+		sock, addr, err := dialUDPSock(c.target, c.opts)
+		if err == nil {
+			c.mtx.Lock()
+			old := *c.sock.Load()
+			if c.closed.Load() {
+				c.mtx.Unlock()
+				sock.Close()
+				return
+			}
+			c.sock.Store(&sock)
+			c.rebuilding = false
+			c.lastRebuild = time.Now()
+			atomic.StoreInt32(&c.failures, 0)
+			c.mtx.Unlock()
+			old.Close()
+			log.Printf("Link to %s: new socket to %s is up", c.target, addr)
+			return
+		}
+		log.Printf("Link to %s: failed to create a new socket: %v", c.target, err)
+		if !c.rebuildWait() {
+			return
+		}
+	}
+}
+
+// rebuildWait backs off and returns false if the link was closed meanwhile.
+func (c *directConn) rebuildWait() bool {
+	c.rebuilds.wait()
+	_, closed := c.current()
+	return !closed
+}
+
+func (c *directConn) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.closed.Store(true)
+	return (*c.sock.Load()).Close()
+}
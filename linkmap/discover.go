@@ -0,0 +1,130 @@
+package linkmap
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// ifaceWatcher keeps a link over every matching interface with internet.
+type ifaceWatcher struct {
+	lm       *Map
+	patterns []string
+	target   string
+	links    map[string]discoveredLink
+}
+
+type discoveredLink struct {
+	linkId int
+	source net.IP
+}
+
+// WatchInterfaces keeps a link to target over every interface matching one of
+// patterns (see filepath.Match) that has a global IPv4 address and a default
+// route, as they come and go. target is like for InitiateLink, without link
+// options.
+func (lm *Map) WatchInterfaces(patterns []string, target string) error {
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("bad interface pattern %q: %v", p, err)
+		}
+	}
+	events, err := watchNetlink()
+	if err != nil {
+		return err
+	}
+	w := &ifaceWatcher{
+		lm:       lm,
+		patterns: patterns,
+		target:   target,
+		links:    map[string]discoveredLink{},
+	}
+	w.sync()
+	go func() {
+		for range events {
+			// Changes come in bursts, so wait for them to settle.
+			time.Sleep(500 * time.Millisecond)
+			select {
+			case <-events:
+			default:
+			}
+			w.sync()
+		}
+		log.Printf("Stopped watching network interfaces")
+	}()
+	return nil
+}
+
+// sync creates and removes links so there is one for every eligible interface.
+func (w *ifaceWatcher) sync() {
+	want, err := w.eligible()
+	if err != nil {
+		log.Printf("Failed to list network interfaces: %v", err)
+		return
+	}
+	for name, dl := range w.links {
+		if src, ok := want[name]; !ok || !src.Equal(dl.source) {
+			log.Printf("Interface %s lost its address %s or default route", name, dl.source)
+			w.lm.RemoveLink(dl.linkId)
+			delete(w.links, name)
+		}
+	}
+	for name, src := range want {
+		if _, ok := w.links[name]; ok {
+			continue
+		}
+		w.lm.mtx.Lock()
+		linkId, err := w.lm.initiateLink(fmt.Sprintf("%s;dev=%s;src=%s", w.target, name, src))
+		w.lm.mtx.Unlock()
+		if err != nil {
+			log.Printf("Failed to create link over interface %s: %v", name, err)
+			continue
+		}
+		log.Printf("Interface %s came up with address %s, using it as link %d", name, src, linkId)
+		w.links[name] = discoveredLink{linkId: linkId, source: src}
+	}
+}
+
+// eligible returns the usable interfaces with the address to send from.
+func (w *ifaceWatcher) eligible() (map[string]net.IP, error) {
+	routes, err := defaultRouteInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]net.IP{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || !routes[iface.Name] || !w.matches(iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip4 := ipn.IP.To4(); ip4 != nil && ip4.IsGlobalUnicast() {
+				ret[iface.Name] = ip4
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (w *ifaceWatcher) matches(name string) bool {
+	for _, p := range w.patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
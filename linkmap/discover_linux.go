@@ -0,0 +1,79 @@
+package linkmap
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchNetlink signals on the returned channel when links, addresses or IPv4
+// routes change.
+func watchNetlink() (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR | unix.RTMGRP_IPV4_ROUTE,
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		defer syscall.Close(fd)
+		buf := make([]byte, 65536)
+		for {
+			_, _, err := syscall.Recvfrom(fd, buf, 0)
+			switch err {
+			case nil, syscall.ENOBUFS:
+				// ENOBUFS means we missed changes.
+			case syscall.EINTR:
+				continue
+			default:
+				log.Printf("Reading from rtnetlink failed: %v", err)
+				return
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// defaultRouteInterfaces returns the interfaces with an IPv4 default route.
+func defaultRouteInterfaces() (map[string]bool, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret := map[string]bool{}
+	s := bufio.NewScanner(f)
+	s.Scan() // Skip the header.
+	for s.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+		fields := strings.Fields(s.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil {
+			continue
+		}
+		if fields[1] == "00000000" && fields[7] == "00000000" && flags&syscall.RTF_UP != 0 {
+			ret[fields[0]] = true
+		}
+	}
+	return ret, s.Err()
+}
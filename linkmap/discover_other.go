@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package linkmap
+
+import "errors"
+
+func watchNetlink() (<-chan struct{}, error) {
+	return nil, errors.New("watching network interfaces is only supported on Linux")
+}
+
+func defaultRouteInterfaces() (map[string]bool, error) {
+	return nil, errors.New("watching network interfaces is only supported on Linux")
+}
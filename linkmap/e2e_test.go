@@ -0,0 +1,126 @@
+package linkmap
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/Jille/bindlink/linkmap/memconn"
+	"github.com/Jille/bindlink/multiplexer"
+	"github.com/Jille/bindlink/tundev/memdev"
+)
+
+type e2eSide struct {
+	dev *memdev.Device
+	mp  *multiplexer.Mux
+	lm  *Map
+}
+
+func newE2ESide() *e2eSide {
+	s := &e2eSide{
+		dev: memdev.New(10000),
+		mp:  multiplexer.New(),
+	}
+	s.lm = New(s.mp)
+	s.mp.Start(s.dev.Send, s.lm.Send)
+	go s.dev.Run(s.mp.Send)
+	return s
+}
+
+// TestEndToEnd runs a master and a slave over four emulated links and checks
+// that traffic both ways arrives and uses every link.
+func TestEndToEnd(t *testing.T) {
+	const (
+		links   = 4
+		packets = 2000
+	)
+	master, slave := newE2ESide(), newE2ESide()
+	defer master.dev.Close()
+	defer slave.dev.Close()
+	// The listener isn't closed: Map would keep retrying to read from it.
+	listener := memconn.NewListener(4000, 1)
+	master.lm.Listen(listener)
+	cfg := memconn.Config{
+		Delay:   2 * time.Millisecond,
+		Jitter:  time.Millisecond,
+		Reorder: 0.1,
+	}
+	conns := make([]*memconn.Conn, links)
+	for i := range conns {
+		conns[i] = listener.Dial(cfg, cfg)
+		slave.lm.AddLink(conns[i])
+	}
+	defer func() {
+		for id := 1; id <= links; id++ {
+			slave.lm.RemoveLink(id)
+		}
+	}()
+
+	// Without control packets both sides only use the first link.
+	slave.lm.broadcastControl()
+	deadline := time.Now().Add(5 * time.Second)
+	for id := 1; id <= links; id++ {
+		for master.lm.lookup(id) == nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("master didn't accept link %d", id)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// The master weighed the links before it knew all of them, so do another
+	// round.
+	slave.lm.broadcastControl()
+	master.lm.broadcastControl()
+	time.Sleep(50 * time.Millisecond)
+
+	type direction struct {
+		name     string
+		from, to *e2eSide
+	}
+	dirs := []direction{{"up", slave, master}, {"down", master, slave}}
+	done := make(chan error, len(dirs))
+	for _, d := range dirs {
+		go func(d direction) {
+			buf := make([]byte, 100)
+			for seq := 0; seq < packets; seq++ {
+				binary.BigEndian.PutUint32(buf, uint32(seq))
+				d.from.dev.Inject(buf)
+				if seq%10 == 9 {
+					// Don't overflow the emulated links' receive queues.
+					time.Sleep(time.Millisecond)
+				}
+			}
+			done <- nil
+		}(d)
+	}
+	for range dirs {
+		<-done
+	}
+
+	for _, d := range dirs {
+		seen := make([]bool, packets)
+		count := 0
+		timeout := time.After(10 * time.Second)
+		for count < packets {
+			select {
+			case p := <-d.to.dev.Received():
+				seq := binary.BigEndian.Uint32(p)
+				if seq >= packets || seen[seq] {
+					t.Fatalf("%s: got unexpected or duplicate packet %d", d.name, seq)
+				}
+				seen[seq] = true
+				count++
+			case <-timeout:
+				t.Fatalf("%s: only %d of %d packets arrived", d.name, count, packets)
+			}
+		}
+	}
+
+	for i, c := range conns {
+		up, down := c.Stats()
+		// Links are picked at random, so allow for some skew.
+		if min := uint64(packets / links / 2); up.Packets < min || down.Packets < min {
+			t.Errorf("link %d carried %d packets up and %d down, want at least %d both ways", i+1, up.Packets, down.Packets, min)
+		}
+	}
+}
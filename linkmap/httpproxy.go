@@ -0,0 +1,87 @@
+package linkmap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var ErrHTTPProxyAuthRejected = errors.New("HTTP proxy rejected authentication")
+
+// HTTPProxy is an HTTP proxy that supports CONNECT.
+type HTTPProxy struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+// ParseHTTPProxy parses "host:port" or "user:pass@host:port", with the
+// credentials optionally URL escaped.
+func ParseHTTPProxy(s string) (HTTPProxy, error) {
+	addr, user, pass, err := parseProxyCredentials(s)
+	if err != nil {
+		return HTTPProxy{}, err
+	}
+	return HTTPProxy{
+		Addr:     addr,
+		Username: user,
+		Password: pass,
+	}, nil
+}
+
+// String returns the proxy without its password, so it's safe to log.
+func (p HTTPProxy) String() string {
+	return redactedProxy(p.Addr, p.Username)
+}
+
+// dialHTTPProxy returns a tunnel to target through proxy.
+func dialHTTPProxy(proxy HTTPProxy, target string) (*streamConn, error) {
+	conn, err := net.DialTimeout("tcp", proxy.Addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: http.Header{},
+	}
+	if proxy.Username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(proxy.Username + ":" + proxy.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Our peer's first packets may follow the response, so keep reading from
+	// br.
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusProxyAuthRequired:
+		conn.Close()
+		return nil, ErrHTTPProxyAuthRejected
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT to %s failed: %s", target, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(4 * time.Second)
+	}
+	return newStreamConn(conn, br, "http_proxy"), nil
+}
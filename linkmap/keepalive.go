@@ -0,0 +1,279 @@
+package linkmap
+
+import (
+	"encoding/binary"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// assumedNATTimeout is used until probing finds better. Carrier NATs go as
+	// low as 20s.
+	assumedNATTimeout = 15 * time.Second
+	// maxNATProbe is the longest idle period we probe for.
+	maxNATProbe = 30 * time.Minute
+	// natProbeGrace is how late the answer to a probe may be.
+	natProbeGrace = 3 * time.Second
+	// natProbePrecision is when we stop narrowing down the NAT timeout.
+	natProbePrecision = 5 * time.Second
+	// natReprobeInterval is how often we probe again, in case the NAT changed.
+	natReprobeInterval = 30 * time.Minute
+	// controlStale is how long an accepted link may go without control packets
+	// before we stop sending ours over it.
+	controlStale = 5 * time.Second
+)
+
+// keepalive keeps the NAT mapping of an idle link alive with minimal packets.
+type keepalive struct {
+	// lastSent is in unix nanoseconds.
+	lastSent atomic.Int64
+	interval time.Duration
+
+	// The rest is only used with automatic keepalives.
+	auto bool
+	// good is the longest idle period that survived, bad the shortest that
+	// didn't.
+	good      time.Duration
+	bad       time.Duration
+	probe     *natProbe
+	nextProbe time.Time
+}
+
+// natProbe asks the peer to send us a packet after an idle period.
+type natProbe struct {
+	token uint32
+	idle  time.Duration
+	sent  int64
+}
+
+// probeAnswer is a NAT probe from the peer we'll answer after its idle period.
+type probeAnswer struct {
+	timer *time.Timer
+	// spoiled is set if we sent anything else meanwhile.
+	spoiled atomic.Bool
+}
+
+func newKeepalive(opts linkOptions) *keepalive {
+	ka := &keepalive{
+		interval: opts.keepalive,
+		auto:     opts.keepaliveAuto,
+	}
+	ka.lastSent.Store(time.Now().UnixNano())
+	if ka.auto {
+		ka.good = assumedNATTimeout
+		ka.updateInterval()
+	}
+	return ka
+}
+
+// updateInterval stays well below the longest idle period known to work.
+func (ka *keepalive) updateInterval() {
+	ka.interval = ka.good * 4 / 5
+	if ka.interval < time.Second {
+		ka.interval = time.Second
+	}
+}
+
+// nextProbeIdle returns the idle period to probe next, or zero if done.
+func (ka *keepalive) nextProbeIdle() time.Duration {
+	if ka.bad == 0 {
+		if ka.good >= maxNATProbe {
+			return 0
+		}
+		if d := ka.good * 2; d < maxNATProbe {
+			return d
+		}
+		return maxNATProbe
+	}
+	if ka.bad-ka.good <= natProbePrecision {
+		return 0
+	}
+	return (ka.good + ka.bad) / 2
+}
+
+func (ka *keepalive) sent() {
+	ka.lastSent.Store(time.Now().UnixNano())
+}
+
+// sendKeepalives sends keepalives and NAT probes over idle links.
+func (lm *Map) sendKeepalives() {
+	lm.mtx.Lock()
+	defer lm.mtx.Unlock()
+	now := time.Now()
+	lm.forEachLink(func(l *link) {
+		if l.keepalive != nil {
+			lm.keepAlive(l, now)
+		}
+	})
+}
+
+// keepAlive sends a keepalive or NAT probe over l if needed. lm.mtx must be
+// held.
+func (lm *Map) keepAlive(l *link, now time.Time) {
+	ka := l.keepalive
+	lastSent := ka.lastSent.Load()
+	if p := ka.probe; p != nil {
+		if lastSent > p.sent {
+			// We sent something meanwhile, so try again later.
+			ka.probe = nil
+			ka.nextProbe = now.Add(ka.interval)
+			return
+		}
+		if now.Before(time.Unix(0, p.sent).Add(p.idle + natProbeGrace)) {
+			return
+		}
+		ka.probe = nil
+		ka.bad = p.idle
+		log.Printf("Link %d: NAT mapping didn't survive %s idle, keeping it alive every %s", l.id, p.idle, ka.interval)
+		// Open a new mapping right away.
+		lm.sendKeepalive(l, nil)
+		return
+	}
+	if now.Sub(time.Unix(0, lastSent)) < ka.interval {
+		return
+	}
+	if ka.auto && !now.Before(ka.nextProbe) {
+		if idle := ka.nextProbeIdle(); idle > 0 {
+			p := &natProbe{
+				token: rand.Uint32(),
+				idle:  idle,
+			}
+			var payload [6]byte
+			binary.BigEndian.PutUint16(payload[:], uint16(idle/time.Second))
+			binary.BigEndian.PutUint32(payload[2:], p.token)
+			lm.sendKeepalive(l, payload[:])
+			p.sent = ka.lastSent.Load()
+			ka.probe = p
+			return
+		}
+		// We know the timeout well enough. Check again later.
+		ka.bad = 0
+		ka.nextProbe = now.Add(natReprobeInterval)
+	}
+	lm.sendKeepalive(l, nil)
+}
+
+func (lm *Map) sendKeepalive(l *link, payload []byte) {
+	pkt := append([]byte{'B', 'L', 'K', byte(l.id)}, payload...)
+	if err := lm.send(l, pkt); err != nil {
+		log.Printf("Failed to send keepalive over link %d: %v", l.id, err)
+	}
+}
+
+// handleKeepalive handles a keepalive. A probe asks us to send its token back
+// after an idle period, which tells the prober its mapping survived.
+func (lm *Map) handleKeepalive(l *link, payload []byte) {
+	switch len(payload) {
+	case 6:
+		idle := time.Duration(binary.BigEndian.Uint16(payload)) * time.Second
+		if idle > maxNATProbe {
+			return
+		}
+		token := binary.BigEndian.Uint32(payload[2:])
+		lm.mtx.Lock()
+		defer lm.mtx.Unlock()
+		// Only the latest probe is answered.
+		pa := &probeAnswer{}
+		if old := l.probeAnswer.Swap(pa); old != nil {
+			old.timer.Stop()
+		}
+		pa.timer = time.AfterFunc(idle, func() {
+			lm.answerProbe(l, pa, token)
+		})
+	case 4, 5:
+		ka := l.keepalive
+		if ka == nil {
+			return
+		}
+		lm.mtx.Lock()
+		defer lm.mtx.Unlock()
+		if ka.probe == nil || ka.probe.token != binary.BigEndian.Uint32(payload) {
+			return
+		}
+		if len(payload) == 5 || ka.lastSent.Load() > ka.probe.sent {
+			// The probe was spoiled by other traffic.
+			ka.probe = nil
+			ka.nextProbe = time.Now().Add(ka.interval)
+			return
+		}
+		ka.good = ka.probe.idle
+		ka.probe = nil
+		ka.updateInterval()
+		log.Printf("Link %d: NAT mapping survived %s idle, keeping it alive every %s", l.id, ka.good, ka.interval)
+	}
+}
+
+func (lm *Map) answerProbe(l *link, pa *probeAnswer, token uint32) {
+	if !l.probeAnswer.CompareAndSwap(pa, nil) || lm.lookup(l.id) != l {
+		// Replaced by a newer probe, or the link is gone.
+		return
+	}
+	var answer [9]byte
+	copy(answer[:], []byte{'B', 'L', 'K', byte(l.id)})
+	binary.BigEndian.PutUint32(answer[4:], token)
+	pkt := answer[:8]
+	if pa.spoiled.Load() {
+		// An extra byte tells the prober not to trust this answer.
+		answer[8] = 1
+		pkt = answer[:9]
+	}
+	if err := lm.send(l, pkt); err != nil {
+		log.Printf("Failed to answer NAT probe on link %d: %v", l.id, err)
+	}
+}
+
+// stopProbeAnswer cancels the pending answer to a NAT probe over l, if any.
+func (l *link) stopProbeAnswer() {
+	if pa := l.probeAnswer.Swap(nil); pa != nil {
+		pa.timer.Stop()
+	}
+}
+
+// sending is called before anything is sent over l.
+func (l *link) sending() {
+	if l.keepalive != nil {
+		l.keepalive.sent()
+	}
+	if pa := l.probeAnswer.Load(); pa != nil && !pa.spoiled.Load() {
+		pa.spoiled.Store(true)
+	}
+}
+
+// controlFallback picks the link to send control packets over when none wants
+// them: the one used most recently, so the others can stay idle. Links probing
+// their NAT timeout are left alone, or the probe would be spoiled.
+func (lm *Map) controlFallback(links []*link) *link {
+	lm.mtx.Lock()
+	defer lm.mtx.Unlock()
+	var best *link
+	var bestUsed int64
+	for _, l := range links {
+		if l.probeAnswer.Load() != nil {
+			continue
+		}
+		used := l.lastControl.Load()
+		if ka := l.keepalive; ka != nil {
+			if ka.probe != nil {
+				continue
+			}
+			used = ka.lastSent.Load()
+		}
+		if best == nil || used > bestUsed {
+			best, bestUsed = l, used
+		}
+	}
+	return best
+}
+
+// wantsControl returns whether we should send our control packets over l.
+func (l *link) wantsControl(now time.Time) bool {
+	if l.keepalive != nil {
+		return false
+	}
+	if t := l.lastControl.Load(); t != 0 && now.Sub(time.Unix(0, t)) > controlStale {
+		return false
+	}
+	return true
+}
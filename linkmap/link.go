@@ -0,0 +1,99 @@
+package linkmap
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jille/bindlink/packet"
+)
+
+// maxLinks is the size of the link table. Link ids are a byte on the wire.
+const maxLinks = 256
+
+// link is the state of one link. Sending and receiving only use atomics.
+type link struct {
+	id int
+	// path changes when the peer of a link we accepted migrates.
+	path atomic.Pointer[linkPath]
+	// keepalive is optional. Its probing state is guarded by lm.mtx.
+	keepalive *keepalive
+	// lastControl is in unix nanoseconds, and zero for links we initiated.
+	lastControl atomic.Int64
+	// initiated is set for links we started, as the slave.
+	initiated bool
+	// key authenticates the slave when the link moves, unless --link_secret is
+	// set. We make it up for links we initiate and learn it for links we accept.
+	key atomic.Pointer[[linkKeySize]byte]
+	// challenges and lastRefusal are guarded by lm.mtx.
+	challenges  []*challenge
+	lastRefusal time.Time
+	// probeAnswer is the NAT probe from the peer we still have to answer.
+	probeAnswer atomic.Pointer[probeAnswer]
+}
+
+// linkPath is how packets for a link reach the other side. It's immutable.
+type linkPath struct {
+	sock UDPLikeConn
+	addr *net.UDPAddr
+	// listener is set when sock is unconnected and packets go to addr.
+	listener UDPListener
+}
+
+func (p *linkPath) write(b []byte) error {
+	var err error
+	if p.listener != nil {
+		_, err = p.listener.WriteToUDP(b, p.addr)
+	} else {
+		_, err = p.sock.Write(b)
+	}
+	return err
+}
+
+// writeBuffer sends b, without copying it if the socket can queue it as is.
+func (p *linkPath) writeBuffer(b *packet.Buffer) error {
+	if p.listener != nil {
+		if bw, ok := p.listener.(bufferWriter); ok {
+			return bw.WriteBuffer(b, p.addr)
+		}
+	} else if bw, ok := p.sock.(bufferWriter); ok {
+		return bw.WriteBuffer(b, nil)
+	}
+	return p.write(b.Bytes())
+}
+
+// bufferWriter sends a packet.Buffer without copying. addr is nil if connected.
+type bufferWriter interface {
+	WriteBuffer(p *packet.Buffer, addr *net.UDPAddr) error
+}
+
+// matches returns whether sock and addr are this path.
+func (p *linkPath) matches(sock UDPLikeConn, addr *net.UDPAddr) bool {
+	return p.sock == sock && sameUDPAddr(p.addr, addr)
+}
+
+// acceptedPath returns the path for a link we learned from a packet over sock.
+func acceptedPath(sock UDPLikeConn, addr *net.UDPAddr) *linkPath {
+	p := &linkPath{sock: sock, addr: addr}
+	if l, ok := sock.(UDPListener); ok {
+		p.listener = l
+	}
+	return p
+}
+
+// lookup returns the link with linkId, or nil. It doesn't need lm.mtx.
+func (lm *Map) lookup(linkId int) *link {
+	if linkId < 0 || linkId >= maxLinks {
+		return nil
+	}
+	return lm.links[linkId].Load()
+}
+
+// forEachLink calls f for every link.
+func (lm *Map) forEachLink(f func(*link)) {
+	for i := range lm.links {
+		if l := lm.links[i].Load(); l != nil {
+			f(l)
+		}
+	}
+}
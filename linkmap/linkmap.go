@@ -1,14 +1,31 @@
 package linkmap
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Jille/bindlink/multiplexer"
+	"github.com/Jille/bindlink/packet"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metrLinkTransport = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "link_transport",
+			Help: "Transport a link is currently using, always 1",
+		},
+		[]string{"link", "transport"})
 )
 
 type UDPLikeConn interface {
@@ -16,120 +33,339 @@ type UDPLikeConn interface {
 	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
 }
 
+// UDPListener is an unconnected UDPLikeConn.
+type UDPListener interface {
+	UDPLikeConn
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+}
+
 var _ UDPLikeConn = &net.UDPConn{}
+var _ UDPListener = &net.UDPConn{}
 
 type Map struct {
+	// mtx serializes changes to links. Sending and receiving don't take it.
 	mtx        sync.Mutex
 	mp         *multiplexer.Mux
-	listener   *net.UDPConn
+	links      [maxLinks]atomic.Pointer[link]
 	nextLinkId int
-	linkToAddr map[int]*net.UDPAddr
-	linkToConn map[int]UDPLikeConn
+	listeners  []UDPListener
 }
 
 func New(mp *multiplexer.Mux) *Map {
 	return &Map{
-		mp:         mp,
-		linkToAddr: map[int]*net.UDPAddr{},
-		linkToConn: map[int]UDPLikeConn{},
+		mp: mp,
 	}
 }
 
+// StartListener accepts links on UDP port, with a reader per core if possible.
 func (lm *Map) StartListener(port int) error {
-	lm.mtx.Lock()
-	defer lm.mtx.Unlock()
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
+	socks, err := listenUDP(port)
 	if err != nil {
 		return err
 	}
-	sock, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		return err
+	for _, sock := range socks {
+		lm.Listen(newBatchConn(sock))
 	}
-	lm.listener = sock
-	go lm.handleSocket(-1, sock)
 	return nil
 }
 
+// Listen accepts links from the other side over sock. It can be called more
+// than once.
+func (lm *Map) Listen(sock UDPListener) {
+	lm.mtx.Lock()
+	lm.listeners = append(lm.listeners, sock)
+	lm.mtx.Unlock()
+	go lm.handleSocket(-1, sock)
+}
+
+// StopListening closes the sockets given to Listen and StartListener. Links
+// accepted over them can't send anymore, remove them with RemoveLink.
+func (lm *Map) StopListening() {
+	lm.mtx.Lock()
+	listeners := lm.listeners
+	lm.listeners = nil
+	lm.mtx.Unlock()
+	for _, sock := range listeners {
+		if c, ok := sock.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// InitiateLink starts a link to targetAddr: a UDP host:port, prefixed with
+// tcp:// or tls:// for a stream, or a ws:// or wss:// URL.
+// Link options like ;src=<ip>, ;dev=<interface>, ;mark=<fwmark> and
+// ;keepalive=<duration|auto> can follow.
 func (lm *Map) InitiateLink(targetAddr string) error {
 	lm.mtx.Lock()
 	defer lm.mtx.Unlock()
-	addr, err := net.ResolveUDPAddr("udp", targetAddr)
+	_, err := lm.initiateLink(targetAddr)
+	return err
+}
+
+// initiateLink is InitiateLink with lm.mtx held. It returns the new link id.
+func (lm *Map) initiateLink(targetAddr string) (int, error) {
+	targetAddr, opts, err := splitLinkOptions(targetAddr)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	sock, err := net.DialUDP("udp", nil, addr)
+	sock, addr, err := dialLink(targetAddr, opts)
+	if err != nil {
+		return 0, err
+	}
+	var ka *keepalive
+	if opts.keepalive != 0 || opts.keepaliveAuto {
+		ka = newKeepalive(opts)
+	}
+	return lm.newLink(sock, addr, ka), nil
+}
+
+func dialLink(targetAddr string, opts linkOptions) (UDPLikeConn, *net.UDPAddr, error) {
+	if strings.HasPrefix(targetAddr, "ws://") || strings.HasPrefix(targetAddr, "wss://") {
+		sock, err := dialWebSocketLink(targetAddr, opts)
+		return sock, nil, err
+	}
+	if i := strings.Index(targetAddr, "://"); i != -1 {
+		sock, err := dialStreamLink(targetAddr[:i], targetAddr[i+3:], opts)
+		return sock, nil, err
+	}
+	sock, addr, err := dialDirect(targetAddr, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sock, addr, nil
+}
+
+func dialStreamLink(transport, target string, opts linkOptions) (UDPLikeConn, error) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	switch transport {
+	case "tcp":
+	case "tls":
+		tlsConfig, err = clientTLSConfig(host)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown transport %q", transport)
+	}
+	return newRedialingStream(transport+"://"+target, transport, func() (streamLink, error) {
+		return dialStream(transport, target, tlsConfig, opts)
+	}), nil
+}
+
+func dialWebSocketLink(target string, opts linkOptions) (UDPLikeConn, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("WebSocket URL %q has no host", target)
+	}
+	return newRedialingStream(target, "websocket", func() (streamLink, error) {
+		return dialWebSocket(target, opts)
+	}), nil
+}
+
+func (lm *Map) InitiateLinkOverSOCKS(proxy SOCKSProxy, target string) error {
+	lm.mtx.Lock()
+	defer lm.mtx.Unlock()
+	sock, err := NewUDPOverSocks(proxy, target)
 	if err != nil {
 		return err
 	}
-	lm.newLink(sock, addr)
+	lm.newLink(sock, nil, nil)
 	return nil
 }
 
-func (lm *Map) InitiateLinkOverSOCKS(proxyAddr, target string) error {
+func (lm *Map) InitiateLinkOverHTTPProxy(proxy HTTPProxy, target string) error {
 	lm.mtx.Lock()
 	defer lm.mtx.Unlock()
-	sock, err := NewUDPOverSocks(proxyAddr, target)
-	if err != nil {
+	if _, _, err := net.SplitHostPort(target); err != nil {
 		return err
 	}
-	lm.newLink(sock, nil)
+	lm.newLink(newRedialingStream(fmt.Sprintf("%s through HTTP proxy %s", target, proxy), "http_proxy", func() (streamLink, error) {
+		return dialHTTPProxy(proxy, target)
+	}), nil, nil)
 	return nil
 }
 
-func (lm *Map) newLink(sock UDPLikeConn, addr *net.UDPAddr) {
-	lm.nextLinkId++
-	linkId := lm.nextLinkId
+// AddLink starts a new link over an already connected sock.
+func (lm *Map) AddLink(sock UDPLikeConn) {
+	lm.mtx.Lock()
+	defer lm.mtx.Unlock()
+	lm.newLink(sock, nil, nil)
+}
+
+// newLink sets up a link we initiated over sock. lm.mtx must be held.
+func (lm *Map) newLink(sock UDPLikeConn, addr *net.UDPAddr, ka *keepalive) int {
+	linkId := lm.allocLinkId()
 	log.Printf("InitiateLink(%s): got link id %d", addr, linkId)
-	if linkId > 255 {
-		panic("ran out of link ids")
+	l := &link{
+		id:        linkId,
+		keepalive: ka,
+		initiated: true,
 	}
+	l.path.Store(&linkPath{sock: sock, addr: addr})
+	l.key.Store(newLinkKey())
 	lm.mp.AddLink(linkId)
-	lm.linkToConn[linkId] = sock
-	lm.linkToAddr[linkId] = addr
+	lm.links[linkId].Store(l)
+	setTransportMetric(linkId, sock)
+	lm.watchLinkState(linkId, sock)
 	go lm.handleSocket(linkId, sock)
+	return linkId
+}
+
+// allocLinkId returns the next unused link id, wrapping around.
+func (lm *Map) allocLinkId() int {
+	for i := 0; i < maxLinks-1; i++ {
+		lm.nextLinkId = lm.nextLinkId%(maxLinks-1) + 1
+		if lm.links[lm.nextLinkId].Load() == nil {
+			return lm.nextLinkId
+		}
+	}
+	panic("ran out of link ids")
+}
+
+// RemoveLink stops using linkId and closes its socket.
+func (lm *Map) RemoveLink(linkId int) {
+	lm.mtx.Lock()
+	defer lm.mtx.Unlock()
+	l := lm.lookup(linkId)
+	if l == nil {
+		return
+	}
+	log.Printf("Removing link %d", linkId)
+	// Stop the multiplexer from picking the link first, so few packets are
+	// sent to a link that's gone.
+	lm.mp.RemoveLink(linkId)
+	lm.links[linkId].Store(nil)
+	l.stopProbeAnswer()
+	metrLinkTransport.DeletePartialMatch(prometheus.Labels{"link": strconv.Itoa(linkId)})
+	p := l.path.Load()
+	lm.unwatchLinkState(linkId, p.sock)
+	if c, ok := p.sock.(io.Closer); ok && p.listener == nil {
+		c.Close()
+	}
+}
+
+// transportOf returns how sock carries packets, UDP unless it says otherwise.
+func transportOf(sock UDPLikeConn) string {
+	if t, ok := sock.(interface{ Transport() string }); ok {
+		return t.Transport()
+	}
+	return "udp"
+}
+
+func setTransportMetric(linkId int, sock UDPLikeConn) {
+	link := strconv.Itoa(linkId)
+	metrLinkTransport.DeletePartialMatch(prometheus.Labels{"link": link})
+	metrLinkTransport.With(prometheus.Labels{"link": link, "transport": transportOf(sock)}).Set(1)
 }
 
 func (lm *Map) Run() {
 	for {
 		time.Sleep(time.Second)
 		lm.broadcastControl()
+		lm.requestLinkKeys()
+		lm.sendKeepalives()
 	}
 }
 
 func (lm *Map) broadcastControl() {
-	lm.mtx.Lock()
-	defer lm.mtx.Unlock()
 	cp := lm.mp.CraftControl()
 	buf := make([]byte, len(cp)+4)
 	buf[0] = 'B'
 	buf[1] = 'L'
 	buf[2] = 'C'
 	copy(buf[4:], cp)
-	for linkId := range lm.linkToAddr {
-		buf[3] = byte(linkId)
-		lm.send(linkId, buf)
+	now := time.Now()
+	var all, links []*link
+	lm.forEachLink(func(l *link) {
+		all = append(all, l)
+		if l.wantsControl(now) {
+			links = append(links, l)
+		}
+	})
+	if len(links) == 0 {
+		if l := lm.controlFallback(all); l != nil {
+			links = append(links, l)
+		}
+	}
+	for _, l := range links {
+		buf[3] = byte(l.id)
+		lm.send(l, buf)
 	}
 }
 
+// handleSocket reads packets from sock until the link is removed.
 func (lm *Map) handleSocket(linkId int, sock UDPLikeConn) {
-	buf := make([]byte, 8192)
+	br, batched := sock.(batchReader)
+	handle := func(b []byte, addr *net.UDPAddr) {
+		lm.handlePacket(linkId, sock, addr, b)
+	}
+	var buf []byte
+	if !batched {
+		buf = make([]byte, readBufferSize)
+	}
+	b := backoff{min: 10 * time.Millisecond, max: time.Second}
 	for {
-		n, addr, err := sock.ReadFromUDP(buf)
+		var err error
+		if batched {
+			err = br.ReadBatch(handle)
+		} else {
+			var n int
+			var addr *net.UDPAddr
+			n, addr, err = sock.ReadFromUDP(buf)
+			if err == nil {
+				handle(buf[:n], addr)
+			}
+		}
 		if err != nil {
 			if strings.Contains(err.Error(), "connection refused") {
 				continue
 			}
-			log.Printf("ReadFromUDP failed: %v", err)
+			if lm.removed(linkId, sock) {
+				return
+			}
+			// Don't spin on errors that don't go away.
+			d := b.next()
+			log.Printf("ReadFromUDP failed on link %d, retrying in %s: %v", linkId, d, err)
+			time.Sleep(d)
 			continue
 		}
-		lm.handlePacket(linkId, sock, addr, buf[:n])
+		b.reset()
+	}
+}
+
+// removed returns whether the link sock served as linkId is gone, or for
+// listeners whether we stopped listening on sock.
+func (lm *Map) removed(linkId int, sock UDPLikeConn) bool {
+	if linkId == -1 {
+		lm.mtx.Lock()
+		defer lm.mtx.Unlock()
+		for _, l := range lm.listeners {
+			if l == sock {
+				return false
+			}
+		}
+		return true
 	}
+	l := lm.lookup(linkId)
+	return l == nil || l.path.Load().sock != sock
 }
 
+// handlePacket handles a packet that came in over sock. linkId is -1 for
+// listeners and accepted streams. Packets of known links over their current
+// path are handled without locking.
 func (lm *Map) handlePacket(linkId int, sock UDPLikeConn, addr *net.UDPAddr, buf []byte) {
-	lm.mtx.Lock()
-	defer lm.mtx.Unlock()
+	if linkId != -1 && lm.removed(linkId, sock) {
+		// The link was removed while we were reading this packet.
+		return
+	}
 	if len(buf) < 4 {
 		log.Printf("Received short packet from %s", addr)
 		return
@@ -142,52 +378,79 @@ func (lm *Map) handlePacket(linkId int, sock UDPLikeConn, addr *net.UDPAddr, buf
 	if linkId != -1 && remoteLinkId != linkId {
 		panic(fmt.Errorf("got packet for link %d over link %d", remoteLinkId, linkId))
 	}
-	if _, known := lm.linkToAddr[remoteLinkId]; !known {
-		log.Printf("Got packet for new link %d from %s", remoteLinkId, addr)
-		lm.mp.AddLink(remoteLinkId)
-	}
-	if linkId == -1 {
-		lm.linkToAddr[remoteLinkId] = addr
-		lm.linkToConn[remoteLinkId] = sock
+	l := lm.lookup(remoteLinkId)
+	if linkId == -1 && (l == nil || !l.path.Load().matches(sock, addr)) {
+		lm.mtx.Lock()
+		ok := lm.acceptFrom(remoteLinkId, sock, addr, buf)
+		lm.mtx.Unlock()
+		if !ok {
+			return
+		}
+		l = lm.lookup(remoteLinkId)
+		if l == nil {
+			return
+		}
 	}
 	switch buf[2] {
 	case 'C':
+		if l.lastControl.Load() != 0 {
+			l.lastControl.Store(time.Now().UnixNano())
+		}
 		lm.mp.HandleControl(remoteLinkId, buf[4:])
+	case 'K':
+		lm.handleKeepalive(l, buf[4:])
 	case 'D':
 		lm.mp.Received(remoteLinkId, buf[4:])
+	case 'V':
+		lm.answerChallenge(l, sock, buf[4:])
+	case 'H':
+		lm.handleLinkKey(l, buf[4:])
+	case 'R':
+		// A late answer to a challenge for an address we already switched to.
 	default:
 		log.Printf("Packet of unknown type %q/%d from %s", buf[2], buf[2], addr)
 		return
 	}
 }
 
-func (lm *Map) send(linkId int, packet []byte) error {
-	addr := lm.linkToAddr[linkId]
-	sock := lm.linkToConn[linkId]
-	if sock == nil {
-		panic(fmt.Errorf("didn't find socket for link %d", linkId))
+func (lm *Map) send(l *link, packet []byte) error {
+	l.sending()
+	return ignoreNoBuffers(l.path.Load().write(packet))
+}
+
+// ignoreNoBuffers treats a full send queue as packet loss.
+func ignoreNoBuffers(err error) error {
+	if err != nil && strings.Contains(err.Error(), "no buffer space available") {
+		return nil
 	}
-	var err error
-	if sock == lm.listener {
-		_, err = lm.listener.WriteToUDP(packet, addr)
-	} else {
-		_, err = sock.Write(packet)
+	return err
+}
+
+// Send sends p over linkId, adding the header in its headroom if it isn't
+// shared. A packet that can't be sent is lost and counted in link_errors: the
+// link recovers on its own by reconnecting or replacing its socket.
+func (lm *Map) Send(linkId int, p *packet.Buffer) error {
+	l := lm.lookup(linkId)
+	if l == nil {
+		// The multiplexer can pick a link just before it is removed. The
+		// packet is lost, like it would have been on the link.
+		return nil
 	}
-	if err != nil {
-		if strings.Contains(err.Error(), "no buffer space available") {
-			return nil
-		}
-		return err
+	if p.Shared() {
+		// Another link still has it queued, with its own header in front.
+		p = p.Clone()
+		defer p.Release()
+	}
+	hdr := p.Prepend(4)
+	hdr[0] = 'B'
+	hdr[1] = 'L'
+	hdr[2] = 'D'
+	hdr[3] = byte(linkId)
+	l.sending()
+	err := l.path.Load().writeBuffer(p)
+	p.Consume(4)
+	if ignoreNoBuffers(err) != nil {
+		metrLinkErrors.With(prometheus.Labels{"link": strconv.Itoa(linkId)}).Inc()
 	}
 	return nil
 }
-
-func (lm *Map) Send(link int, packet []byte) error {
-	buf := make([]byte, len(packet)+4)
-	buf[0] = 'B'
-	buf[1] = 'L'
-	buf[2] = 'D'
-	buf[3] = byte(link)
-	copy(buf[4:], packet)
-	return lm.send(link, buf)
-}
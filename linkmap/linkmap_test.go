@@ -0,0 +1,90 @@
+package linkmap
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Jille/bindlink/packet"
+)
+
+// testConn counts writes and fails them with err, if set.
+type testConn struct {
+	err    error
+	writes atomic.Int32
+	closed chan struct{}
+}
+
+func newTestConn(err error) *testConn {
+	return &testConn{err: err, closed: make(chan struct{})}
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return len(b), nil
+}
+
+func (c *testConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	<-c.closed
+	return 0, nil, net.ErrClosed
+}
+
+func (c *testConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestSendErrorsAreLoss(t *testing.T) {
+	for _, err := range []error{syscall.ENETUNREACH, syscall.EADDRNOTAVAIL} {
+		lm, _ := newBenchMap(t)
+		lm.AddLink(newTestConn(err))
+		p := packet.Get(100)
+		if err := lm.Send(1, p); err != nil {
+			t.Errorf("Send over a failing link: %v, want the packet dropped", err)
+		}
+		p.Release()
+		lm.RemoveLink(1)
+	}
+}
+
+func TestSendOverRemovedLink(t *testing.T) {
+	lm, _ := newBenchMap(t)
+	p := packet.Get(100)
+	defer p.Release()
+	if err := lm.Send(1, p); err != nil {
+		t.Errorf("Send over a removed link: %v, want the packet dropped", err)
+	}
+}
+
+func TestControlOverOneKeepaliveLink(t *testing.T) {
+	lm, _ := newBenchMap(t)
+	conns := make([]*testConn, 3)
+	lm.mtx.Lock()
+	for i := range conns {
+		conns[i] = newTestConn(nil)
+		lm.newLink(conns[i], nil, newKeepalive(linkOptions{keepalive: time.Minute}))
+	}
+	lm.mtx.Unlock()
+	// Link 2 was used last, but link 3 is probing its NAT timeout.
+	lm.lookup(2).keepalive.lastSent.Add(int64(time.Second))
+	lm.lookup(3).keepalive.lastSent.Add(int64(time.Minute))
+	lm.lookup(3).keepalive.probe = &natProbe{}
+
+	for i := 0; i < 3; i++ {
+		lm.broadcastControl()
+	}
+	for i, c := range conns {
+		want := int32(0)
+		if i == 1 {
+			want = 3
+		}
+		if got := c.writes.Load(); got != want {
+			t.Errorf("link %d got %d control packets, want %d", i+1, got, want)
+		}
+	}
+}
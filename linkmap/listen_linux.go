@@ -0,0 +1,39 @@
+package linkmap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenUDP opens a socket per core on port with SO_REUSEPORT. The kernel
+// hashes peers over them, so packets of a link stay in order.
+func listenUDP(port int) ([]*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	var socks []*net.UDPConn
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		pc, err := lc.ListenPacket(context.Background(), "udp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			for _, s := range socks {
+				s.Close()
+			}
+			return nil, err
+		}
+		socks = append(socks, pc.(*net.UDPConn))
+	}
+	return socks, nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package linkmap
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenUDP opens a single socket on port.
+func listenUDP(port int) ([]*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	sock, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []*net.UDPConn{sock}, nil
+}
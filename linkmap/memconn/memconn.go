@@ -0,0 +1,276 @@
+// Package memconn emulates lossy links for linkmap in memory.
+package memconn
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("memconn: use of closed connection")
+
+// Config describes the behaviour of one direction of a link.
+type Config struct {
+	// Delay is the one way latency of every packet.
+	Delay time.Duration
+	// Jitter is the maximum random extra delay added to every packet.
+	Jitter time.Duration
+	// Loss is the fraction of packets that is dropped.
+	Loss float64
+	// Reorder is the fraction of packets held back until the next one was sent.
+	// It works without Delay.
+	Reorder float64
+	// Bandwidth in bytes per second. Zero means unlimited.
+	Bandwidth int
+	// Buffer is how long a packet may wait for bandwidth. Zero means unlimited.
+	Buffer time.Duration
+}
+
+type packet struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// endpoint is the receiving end of one or more pipes.
+type endpoint struct {
+	addr   *net.UDPAddr
+	in     chan packet
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newEndpoint(addr *net.UDPAddr) *endpoint {
+	return &endpoint{
+		addr:   addr,
+		in:     make(chan packet, 1024),
+		closed: make(chan struct{}),
+	}
+}
+
+func (e *endpoint) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case p := <-e.in:
+		return copy(b, p.data), p.from, nil
+	case <-e.closed:
+		return 0, nil, ErrClosed
+	}
+}
+
+func (e *endpoint) Close() error {
+	e.once.Do(func() {
+		close(e.closed)
+	})
+	return nil
+}
+
+func (e *endpoint) deliver(p packet) {
+	select {
+	case e.in <- p:
+	case <-e.closed:
+	default:
+		// Receive queue full, drop it like the kernel would.
+	}
+}
+
+// maxReorderHold is how long a held packet waits for the next one.
+const maxReorderHold = 50 * time.Millisecond
+
+// pipe is one direction of a link.
+type pipe struct {
+	mtx      sync.Mutex
+	cfg      Config
+	rnd      *rand.Rand
+	nextFree time.Time
+	from     *net.UDPAddr
+	to       *endpoint
+	// held is the packet held back to be delivered after the next one.
+	held *packet
+
+	stats PipeStats
+}
+
+// PipeStats counts the traffic offered to one direction of a link.
+type PipeStats struct {
+	Packets   uint64
+	Bytes     uint64
+	Dropped   uint64
+	Delivered uint64
+}
+
+func (p *pipe) setConfig(cfg Config) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.cfg = cfg
+}
+
+func (p *pipe) send(b []byte) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.stats.Packets++
+	p.stats.Bytes += uint64(len(b))
+	now := time.Now()
+	if p.nextFree.Before(now) {
+		p.nextFree = now
+	}
+	if p.cfg.Buffer > 0 && p.nextFree.Sub(now) > p.cfg.Buffer {
+		p.stats.Dropped++
+		return
+	}
+	if p.cfg.Bandwidth > 0 {
+		p.nextFree = p.nextFree.Add(time.Duration(len(b)) * time.Second / time.Duration(p.cfg.Bandwidth))
+	}
+	if p.cfg.Loss > 0 && p.rnd.Float64() < p.cfg.Loss {
+		p.stats.Dropped++
+		return
+	}
+	delay := p.nextFree.Sub(now) + p.cfg.Delay
+	if p.cfg.Jitter > 0 {
+		delay += time.Duration(p.rnd.Int63n(int64(p.cfg.Jitter)))
+	}
+	pkt := &packet{
+		data: append([]byte(nil), b...),
+		from: p.from,
+	}
+	if p.held == nil && p.cfg.Reorder > 0 && p.rnd.Float64() < p.cfg.Reorder {
+		p.held = pkt
+		time.AfterFunc(delay+maxReorderHold, func() {
+			p.mtx.Lock()
+			defer p.mtx.Unlock()
+			if p.held == pkt {
+				p.held = nil
+				p.deliverAfter(0, pkt)
+			}
+		})
+		return
+	}
+	if p.held != nil {
+		p.deliverAfter(delay, pkt, p.held)
+		p.held = nil
+		return
+	}
+	p.deliverAfter(delay, pkt)
+}
+
+// deliverAfter delivers pkts in order after delay. p.mtx must be held.
+func (p *pipe) deliverAfter(delay time.Duration, pkts ...*packet) {
+	if delay <= 0 {
+		for _, pkt := range pkts {
+			p.stats.Delivered += uint64(len(pkt.data))
+			p.to.deliver(*pkt)
+		}
+		return
+	}
+	time.AfterFunc(delay, func() {
+		p.mtx.Lock()
+		for _, pkt := range pkts {
+			p.stats.Delivered += uint64(len(pkt.data))
+		}
+		p.mtx.Unlock()
+		for _, pkt := range pkts {
+			p.to.deliver(*pkt)
+		}
+	})
+}
+
+// Listener is the master side. It implements linkmap.UDPListener.
+type Listener struct {
+	*endpoint
+	mtx   sync.Mutex
+	conns map[string]*Conn
+	next  int
+	seed  int64
+}
+
+func NewListener(port int, seed int64) *Listener {
+	return &Listener{
+		endpoint: newEndpoint(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port}),
+		conns:    map[string]*Conn{},
+		seed:     seed,
+	}
+}
+
+// Dial returns a new link. up applies to packets towards the listener.
+func (l *Listener) Dial(up, down Config) *Conn {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.next++
+	addr := &net.UDPAddr{IP: net.IPv4(10, 1, byte(l.next>>8), byte(l.next)), Port: 10000 + l.next}
+	c := &Conn{
+		endpoint: newEndpoint(addr),
+	}
+	c.up = &pipe{
+		cfg:  up,
+		rnd:  rand.New(rand.NewSource(l.seed + int64(2*l.next))),
+		from: addr,
+		to:   l.endpoint,
+	}
+	c.down = &pipe{
+		cfg:  down,
+		rnd:  rand.New(rand.NewSource(l.seed + int64(2*l.next+1))),
+		from: l.addr,
+		to:   c.endpoint,
+	}
+	l.conns[addr.String()] = c
+	return c
+}
+
+func (l *Listener) Write(b []byte) (int, error) {
+	return 0, errors.New("memconn: Write on unconnected Listener")
+}
+
+func (l *Listener) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	l.mtx.Lock()
+	c, ok := l.conns[addr.String()]
+	l.mtx.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("memconn: no route to %s", addr)
+	}
+	select {
+	case <-l.closed:
+		return 0, ErrClosed
+	default:
+	}
+	c.down.send(b)
+	return len(b), nil
+}
+
+// Conn is the slave side of a link. It implements linkmap.UDPLikeConn.
+type Conn struct {
+	*endpoint
+	up, down *pipe
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, ErrClosed
+	default:
+	}
+	c.up.send(b)
+	return len(b), nil
+}
+
+// LocalAddr is where the listener sees this link's packets come from.
+func (c *Conn) LocalAddr() *net.UDPAddr {
+	return c.addr
+}
+
+// SetConfig applies to packets sent after the call.
+func (c *Conn) SetConfig(up, down Config) {
+	c.up.setConfig(up)
+	c.down.setConfig(down)
+}
+
+// Stats returns the traffic sent in both directions.
+func (c *Conn) Stats() (up, down PipeStats) {
+	return c.up.getStats(), c.down.getStats()
+}
+
+func (p *pipe) getStats() PipeStats {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.stats
+}
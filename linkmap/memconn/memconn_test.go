@@ -0,0 +1,38 @@
+package memconn
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestReorderWithoutDelay(t *testing.T) {
+	const packets = 500
+	l := NewListener(4000, 1)
+	c := l.Dial(Config{Reorder: 0.2}, Config{})
+	var buf [4]byte
+	for seq := 0; seq < packets; seq++ {
+		binary.BigEndian.PutUint32(buf[:], uint32(seq))
+		c.Write(buf[:])
+	}
+	seen := make([]bool, packets)
+	reordered := 0
+	last := -1
+	for i := 0; i < packets; i++ {
+		n, _, err := l.ReadFromUDP(buf[:])
+		if err != nil || n != 4 {
+			t.Fatalf("ReadFromUDP: %d, %v", n, err)
+		}
+		seq := int(binary.BigEndian.Uint32(buf[:]))
+		if seen[seq] {
+			t.Fatalf("got packet %d twice", seq)
+		}
+		seen[seq] = true
+		if seq < last {
+			reordered++
+		}
+		last = seq
+	}
+	if reordered == 0 {
+		t.Error("no packets were reordered")
+	}
+}
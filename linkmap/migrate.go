@@ -0,0 +1,229 @@
+package linkmap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	linkSecret = flag.String("link_secret", os.Getenv("BINDLINK_LINK_SECRET"), "Shared secret the slave uses to prove it owns a link when the master sees it from a new address; has to be the same on both sides. Without it every link gets a key of its own when it's set up (defaults to $BINDLINK_LINK_SECRET)")
+
+	metrLinkMigrations = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "link_migrations",
+			Help: "Number of times a link moved to a new remote address",
+		},
+		[]string{"link"})
+)
+
+const (
+	nonceSize   = 16
+	linkKeySize = 16
+	// challengeInterval limits how often we challenge the same address.
+	challengeInterval = 500 * time.Millisecond
+	// challengeTimeout is how long the answer to a challenge is accepted.
+	challengeTimeout = 5 * time.Second
+	// maxChallenges per link. The oldest makes room for a new one, so spoofed
+	// addresses can't lock out the real peer.
+	maxChallenges = 16
+	// refusalLogInterval limits how often we log that a link can't move.
+	refusalLogInterval = 10 * time.Second
+)
+
+// challenge is an outstanding path validation of a link's possible new address.
+type challenge struct {
+	sock    UDPLikeConn
+	addr    *net.UDPAddr
+	nonce   [nonceSize]byte
+	created time.Time
+	sent    time.Time
+}
+
+// acceptFrom returns whether a packet for linkId from the listener may be used.
+// A link only moves to another address once the peer answered a challenge
+// there with the link's key or --link_secret.
+func (lm *Map) acceptFrom(linkId int, sock UDPLikeConn, addr *net.UDPAddr, buf []byte) bool {
+	l := lm.lookup(linkId)
+	if l == nil {
+		log.Printf("Got packet for new link %d from %s", linkId, addr)
+		l = &link{id: linkId}
+		l.path.Store(acceptedPath(sock, addr))
+		l.lastControl.Store(time.Now().UnixNano())
+		lm.mp.AddLink(linkId)
+		lm.links[linkId].Store(l)
+		setTransportMetric(linkId, sock)
+		lm.requestLinkKey(l)
+		return true
+	}
+	old := l.path.Load()
+	if old.matches(sock, addr) {
+		// Another reader got here first.
+		return true
+	}
+	if buf[2] == 'R' {
+		lm.handleResponse(l, sock, addr, buf[4:])
+		return false
+	}
+	now := time.Now()
+	if l.macKey() == nil {
+		if now.Sub(l.lastRefusal) > refusalLogInterval {
+			l.lastRefusal = now
+			log.Printf("Link %d showed up at %s, was at %s; not moving it because we don't know its key", linkId, addr, old.addr)
+		}
+		return false
+	}
+	c := l.pendingChallenge(sock, addr, now)
+	if c == nil {
+		if len(l.challenges) >= maxChallenges {
+			n := copy(l.challenges, l.challenges[1:])
+			l.challenges[n] = nil
+			l.challenges = l.challenges[:n]
+		}
+		c = &challenge{
+			sock:    sock,
+			addr:    addr,
+			created: now,
+		}
+		if _, err := rand.Read(c.nonce[:]); err != nil {
+			log.Printf("Failed to generate challenge: %v", err)
+			return false
+		}
+		l.challenges = append(l.challenges, c)
+		log.Printf("Link %d showed up at %s, was at %s; validating the new address", linkId, addr, old.addr)
+	} else if now.Sub(c.sent) < challengeInterval {
+		return false
+	}
+	c.sent = now
+	pkt := append([]byte{'B', 'L', 'V', byte(linkId)}, c.nonce[:]...)
+	if err := acceptedPath(sock, addr).write(pkt); err != nil {
+		log.Printf("Failed to send challenge for link %d to %s: %v", linkId, addr, err)
+	}
+	return false
+}
+
+// pendingChallenge expires old challenges and returns the one for sock and
+// addr. lm.mtx must be held.
+func (l *link) pendingChallenge(sock UDPLikeConn, addr *net.UDPAddr, now time.Time) *challenge {
+	var ret *challenge
+	live := l.challenges[:0]
+	for _, c := range l.challenges {
+		if now.Sub(c.created) > challengeTimeout {
+			continue
+		}
+		live = append(live, c)
+		if c.sock == sock && sameUDPAddr(c.addr, addr) {
+			ret = c
+		}
+	}
+	for i := len(live); i < len(l.challenges); i++ {
+		l.challenges[i] = nil
+	}
+	l.challenges = live
+	return ret
+}
+
+// handleResponse moves l to addr if resp answers its challenge.
+func (lm *Map) handleResponse(l *link, sock UDPLikeConn, addr *net.UDPAddr, resp []byte) {
+	c := l.pendingChallenge(sock, addr, time.Now())
+	if c == nil {
+		return
+	}
+	if len(resp) < nonceSize || !hmac.Equal(resp[:nonceSize], c.nonce[:]) {
+		return
+	}
+	if !hmac.Equal(resp[nonceSize:], challengeMAC(l.macKey(), l.id, c.nonce[:])) {
+		log.Printf("Link %d failed to authenticate from %s, is --link_secret the same on both sides?", l.id, addr)
+		return
+	}
+	l.challenges = nil
+	old := l.path.Load()
+	log.Printf("Link %d migrated from %s to %s", l.id, old.addr, addr)
+	metrLinkMigrations.With(prometheus.Labels{"link": strconv.Itoa(l.id)}).Inc()
+	if old.sock != sock {
+		setTransportMetric(l.id, sock)
+	}
+	l.path.Store(acceptedPath(sock, addr))
+}
+
+// answerChallenge replies to a challenge from the master.
+func (lm *Map) answerChallenge(l *link, sock UDPLikeConn, nonce []byte) {
+	if len(nonce) != nonceSize || !l.initiated {
+		return
+	}
+	pkt := append([]byte{'B', 'L', 'R', byte(l.id)}, nonce...)
+	pkt = append(pkt, challengeMAC(l.macKey(), l.id, nonce)...)
+	if _, err := sock.Write(pkt); err != nil {
+		log.Printf("Failed to answer challenge on link %d: %v", l.id, err)
+	}
+}
+
+func newLinkKey() *[linkKeySize]byte {
+	var k [linkKeySize]byte
+	rand.Read(k[:])
+	return &k
+}
+
+// macKey returns --link_secret, or the key of l. It's nil if we don't know it.
+func (l *link) macKey() []byte {
+	if *linkSecret != "" {
+		return []byte(*linkSecret)
+	}
+	if k := l.key.Load(); k != nil {
+		return k[:]
+	}
+	return nil
+}
+
+// requestLinkKeys asks the slaves for the keys we don't know yet.
+func (lm *Map) requestLinkKeys() {
+	lm.forEachLink(lm.requestLinkKey)
+}
+
+func (lm *Map) requestLinkKey(l *link) {
+	if *linkSecret != "" || l.initiated || l.key.Load() != nil {
+		return
+	}
+	if err := lm.send(l, []byte{'B', 'L', 'H', byte(l.id)}); err != nil {
+		log.Printf("Failed to ask for the key of link %d: %v", l.id, err)
+	}
+}
+
+// handleLinkKey sends the key of a link we initiated when the master asks for
+// it, or learns the key of a link we accepted. The first key we hear over the
+// link sticks, like the first address does.
+func (lm *Map) handleLinkKey(l *link, payload []byte) {
+	if l.initiated {
+		if len(payload) != 0 {
+			return
+		}
+		pkt := append([]byte{'B', 'L', 'H', byte(l.id)}, l.key.Load()[:]...)
+		if err := lm.send(l, pkt); err != nil {
+			log.Printf("Failed to send the key of link %d: %v", l.id, err)
+		}
+		return
+	}
+	if len(payload) == linkKeySize {
+		var k [linkKeySize]byte
+		copy(k[:], payload)
+		l.key.CompareAndSwap(nil, &k)
+	}
+}
+
+// challengeMAC authenticates the answer to a challenge with key.
+func challengeMAC(key []byte, linkId int, nonce []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("bindlink path validation"))
+	m.Write([]byte{byte(linkId)})
+	m.Write(nonce)
+	return m.Sum(nil)
+}
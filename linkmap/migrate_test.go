@@ -0,0 +1,123 @@
+package linkmap
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jille/bindlink/linkmap/memconn"
+)
+
+// movingConn is a link socket that can move to another address, like a direct
+// link that replaced its socket.
+type movingConn struct {
+	cur atomic.Pointer[memconn.Conn]
+	in  chan []byte
+}
+
+func newMovingConn(c *memconn.Conn) *movingConn {
+	m := &movingConn{in: make(chan []byte, 100)}
+	m.move(c)
+	return m
+}
+
+func (m *movingConn) move(c *memconn.Conn) {
+	m.cur.Store(c)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := c.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			m.in <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+}
+
+func (m *movingConn) Write(b []byte) (int, error) {
+	return m.cur.Load().Write(b)
+}
+
+func (m *movingConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	return copy(b, <-m.in), nil, nil
+}
+
+func TestMigrateWithLinkKey(t *testing.T) {
+	if *linkSecret != "" {
+		t.Skip("--link_secret is set")
+	}
+	master, slave := newE2ESide(), newE2ESide()
+	defer master.dev.Close()
+	defer slave.dev.Close()
+	listener := memconn.NewListener(4000, 1)
+	master.lm.Listen(listener)
+	conn := newMovingConn(listener.Dial(memconn.Config{}, memconn.Config{}))
+	slave.lm.AddLink(conn)
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			slave.lm.broadcastControl()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("the master to learn the link's key", func() bool {
+		l := master.lm.lookup(1)
+		return l != nil && l.key.Load() != nil
+	})
+	if got, want := *master.lm.lookup(1).key.Load(), *slave.lm.lookup(1).key.Load(); got != want {
+		t.Fatalf("master learned key %x, slave has %x", got, want)
+	}
+
+	moved := listener.Dial(memconn.Config{}, memconn.Config{})
+	conn.move(moved)
+	waitFor("the link to move", func() bool {
+		return sameUDPAddr(master.lm.lookup(1).path.Load().addr, moved.LocalAddr())
+	})
+}
+
+// recordingListener is a UDPListener that remembers where it sent packets.
+type recordingListener struct {
+	sent []*net.UDPAddr
+}
+
+func (r *recordingListener) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (r *recordingListener) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {}
+}
+
+func (r *recordingListener) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	r.sent = append(r.sent, addr)
+	return len(b), nil
+}
+
+func TestChallengeEviction(t *testing.T) {
+	lm, _ := newBenchMap(t)
+	sock := &recordingListener{}
+	pkt := []byte{'B', 'L', 'C', 1}
+	lm.mtx.Lock()
+	defer lm.mtx.Unlock()
+	lm.acceptFrom(1, sock, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}, pkt)
+	l := lm.lookup(1)
+	l.key.Store(newLinkKey())
+	for port := 1; port <= maxChallenges; port++ {
+		lm.acceptFrom(1, sock, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: port}, pkt)
+	}
+	peer := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 4000}
+	lm.acceptFrom(1, sock, peer, pkt)
+	if got := sock.sent[len(sock.sent)-1]; !sameUDPAddr(got, peer) {
+		t.Errorf("last challenge went to %s, want %s", got, peer)
+	}
+	if l.pendingChallenge(sock, peer, time.Now()) == nil {
+		t.Errorf("no challenge pending for %s after %d spoofed addresses", peer, maxChallenges)
+	}
+}
@@ -0,0 +1,41 @@
+package linkmap
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// parseProxyCredentials splits "user:pass@host:port". The credentials are
+// optional and may be URL escaped.
+func parseProxyCredentials(s string) (addr, user, pass string, err error) {
+	i := strings.LastIndex(s, "@")
+	if i == -1 {
+		return s, "", "", nil
+	}
+	creds := strings.SplitN(s[:i], ":", 2)
+	if len(creds) != 2 {
+		return "", "", "", fmt.Errorf("proxy credentials should be user:pass, got %q", s[:i])
+	}
+	user, err = url.PathUnescape(creds[0])
+	if err != nil {
+		return "", "", "", fmt.Errorf("bad username: %v", err)
+	}
+	pass, err = url.PathUnescape(creds[1])
+	if err != nil {
+		return "", "", "", fmt.Errorf("bad password: %v", err)
+	}
+	if user == "" {
+		return "", "", "", errors.New("proxy username can't be empty")
+	}
+	return s[i+1:], user, pass, nil
+}
+
+// redactedProxy formats a proxy without its password, so it's safe to log.
+func redactedProxy(addr, user string) string {
+	if user == "" {
+		return addr
+	}
+	return user + ":***@" + addr
+}
@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package linkmap
+
+// raceEnabled is set with -race, which makes sync.Pool drop buffers.
+const raceEnabled = true
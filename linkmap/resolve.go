@@ -0,0 +1,110 @@
+package linkmap
+
+import (
+	"flag"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jille/bindlink/packet"
+)
+
+var (
+	resolveInterval = flag.Duration("target_resolve_interval", time.Minute, "How often to re-resolve --targets given by hostname (0 to disable)")
+)
+
+// resolvingConn is a UDP socket to a hostname that is resolved again
+// periodically.
+type resolvingConn struct {
+	sock   *batchConn
+	target string
+
+	// addr and prevAddr are only changed by resolveLoop. prevAddr is updated
+	// first, so packets from the old address keep being accepted.
+	addr     atomic.Pointer[net.UDPAddr]
+	prevAddr atomic.Pointer[net.UDPAddr]
+	closed   atomic.Bool
+}
+
+func dialResolving(target string, opts linkOptions) (*resolvingConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+	sock, err := opts.listenUDP()
+	if err != nil {
+		return nil, err
+	}
+	c := &resolvingConn{
+		sock:   newBatchConn(sock),
+		target: target,
+	}
+	c.addr.Store(addr)
+	if *resolveInterval > 0 {
+		go c.resolveLoop(*resolveInterval)
+	}
+	return c, nil
+}
+
+func (c *resolvingConn) resolveLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if c.closed.Load() {
+			return
+		}
+		addr, err := net.ResolveUDPAddr("udp", c.target)
+		if err != nil {
+			log.Printf("Failed to re-resolve %q, keeping the old address: %v", c.target, err)
+			continue
+		}
+		if old := c.addr.Load(); !sameUDPAddr(addr, old) {
+			log.Printf("Target %q moved from %s to %s", c.target, old, addr)
+			c.prevAddr.Store(old)
+			c.addr.Store(addr)
+		}
+	}
+}
+
+func (c *resolvingConn) Close() error {
+	c.closed.Store(true)
+	return c.sock.Close()
+}
+
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+func (c *resolvingConn) Write(b []byte) (int, error) {
+	return c.sock.WriteToUDP(b, c.addr.Load())
+}
+
+func (c *resolvingConn) WriteBuffer(p *packet.Buffer, _ *net.UDPAddr) error {
+	return c.sock.WriteBuffer(p, c.addr.Load())
+}
+
+// ReadFromUDP only returns packets from the current or previous address.
+func (c *resolvingConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		n, from, err := c.sock.ReadFromUDP(b)
+		if err != nil {
+			return n, from, err
+		}
+		if c.fromTarget(from) {
+			return n, from, nil
+		}
+	}
+}
+
+// ReadBatch is ReadFromUDP for a batch of packets.
+func (c *resolvingConn) ReadBatch(handle func(b []byte, addr *net.UDPAddr)) error {
+	return c.sock.ReadBatch(func(b []byte, from *net.UDPAddr) {
+		if c.fromTarget(from) {
+			handle(b, from)
+		}
+	})
+}
+
+func (c *resolvingConn) fromTarget(from *net.UDPAddr) bool {
+	return sameUDPAddr(from, c.addr.Load()) || sameUDPAddr(from, c.prevAddr.Load())
+}
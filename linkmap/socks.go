@@ -1,223 +1,479 @@
 package linkmap
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
+
+	"github.com/Jille/bindlink/packet"
+	"github.com/Jille/bindlink/socks5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrSOCKSAuthRejected is wrapped in errors for refused credentials.
+var ErrSOCKSAuthRejected = errors.New("SOCKS proxy rejected authentication")
+
+var (
+	metrSOCKSIgnoredPackets = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "socks_ignored_packets",
+			Help: "Number of UDP packets to SOCKS links that didn't come from the proxy's relay",
+		},
+		[]string{"proxy"})
 )
 
-func setupSOCKS(proxy string, target, localAddr *net.UDPAddr) (*net.TCPConn, *net.UDPAddr, error) {
-	proxyAddr, err := net.ResolveTCPAddr("tcp", proxy)
+// SOCKSProxy is a SOCKS5 server to tunnel a link through.
+type SOCKSProxy struct {
+	Addr     string
+	Username string
+	Password string
+	// RemoteDNS leaves resolving the target to the proxy.
+	RemoteDNS bool
+	// FragmentSize is the largest datagram we send to the proxy; larger ones
+	// are fragmented. Zero disables fragmentation.
+	FragmentSize int
+}
+
+// ParseSOCKSProxy parses "host:port" or "user:pass@host:port", with the
+// credentials optionally URL escaped.
+func ParseSOCKSProxy(s string) (SOCKSProxy, error) {
+	addr, user, pass, err := parseProxyCredentials(s)
+	if err != nil {
+		return SOCKSProxy{}, err
+	}
+	if user != "" && (len(user) > 255 || len(pass) > 255) {
+		return SOCKSProxy{}, errors.New("SOCKS username and password should be at most 255 bytes")
+	}
+	return SOCKSProxy{
+		Addr:     addr,
+		Username: user,
+		Password: pass,
+	}, nil
+}
+
+// String returns the proxy without its password, so it's safe to log.
+func (p SOCKSProxy) String() string {
+	return redactedProxy(p.Addr, p.Username)
+}
+
+func setupSOCKS(proxy SOCKSProxy, localAddr *net.UDPAddr) (*net.TCPConn, *net.UDPAddr, error) {
+	proxyAddr, err := net.ResolveTCPAddr("tcp", proxy.Addr)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	sock, err := net.DialTCP("tcp", nil, proxyAddr)
 	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to proxy %s: %w", proxy, err)
+	}
+	conn, addr, err := negotiateSOCKS(sock, proxy, proxyAddr, localAddr)
+	if err != nil {
+		sock.Close()
 		return nil, nil, err
 	}
+	return conn, addr, nil
+}
 
+func negotiateSOCKS(sock *net.TCPConn, proxy SOCKSProxy, proxyAddr *net.TCPAddr, localAddr *net.UDPAddr) (*net.TCPConn, *net.UDPAddr, error) {
 	if localAddr.IP.IsUnspecified() {
 		la := *localAddr
 		la.IP = sock.LocalAddr().(*net.TCPAddr).IP
 		localAddr = &la
 	}
 
-	var greetingReq [3]byte
-	greetingReq[0] = 5 // SOCKS version
-	greetingReq[1] = 1 // number of authentication methods supported
-	greetingReq[2] = 0 // no authentication
+	greetingReq := []byte{
+		5, // SOCKS version
+		1, // number of authentication methods supported
+		0, // no authentication
+	}
+	if proxy.Username != "" {
+		greetingReq[1] = 2
+		greetingReq = append(greetingReq, 2) // username/password
+	}
 
-	if _, err := sock.Write(greetingReq[:]); err != nil {
+	if _, err := sock.Write(greetingReq); err != nil {
 		return nil, nil, err
 	}
 
 	var greetingResp [2]byte
-	if _, err := sock.Read(greetingResp[:]); err != nil {
+	if _, err := io.ReadFull(sock, greetingResp[:]); err != nil {
 		return nil, nil, err
 	}
 
 	if greetingResp[0] != 5 { // SOCKS version
 		return nil, nil, fmt.Errorf("unexpected version in greeting: %d, wanted 5", greetingResp[0])
 	}
-	if greetingResp[1] != 0 { // chosen authentication method
-		return nil, nil, fmt.Errorf("unexpected authentication method in greeting: %d, wanted 0", greetingResp[1])
+	switch greetingResp[1] { // chosen authentication method
+	case 0:
+	case 2:
+		if proxy.Username == "" {
+			return nil, nil, fmt.Errorf("proxy chose username/password authentication, which we didn't offer")
+		}
+		if err := authenticateSOCKS(sock, proxy); err != nil {
+			return nil, nil, err
+		}
+	case 0xff:
+		if proxy.Username == "" {
+			return nil, nil, fmt.Errorf("%w: proxy requires authentication but no credentials were configured", ErrSOCKSAuthRejected)
+		}
+		return nil, nil, fmt.Errorf("%w: proxy accepts none of our authentication methods", ErrSOCKSAuthRejected)
+	default:
+		return nil, nil, fmt.Errorf("unexpected authentication method in greeting: %d", greetingResp[1])
 	}
 
-	var connectReq [10]byte
+	local := socks5.AddrFromUDP(localAddr)
+	connectReq := make([]byte, 3+local.Size())
 	connectReq[0] = 5
-	connectReq[1] = 3 // UDP
+	connectReq[1] = 3 // UDP ASSOCIATE
 	connectReq[2] = 0 // reserved
-	writeHostPort(connectReq[3:], localAddr)
-	fmt.Printf("connectReq: %v\n", connectReq)
+	local.Put(connectReq[3:])
 
-	if _, err := sock.Write(connectReq[:]); err != nil {
+	if _, err := sock.Write(connectReq); err != nil {
 		return nil, nil, err
 	}
 
-	var connectResp [100]byte
-	n, err := sock.Read(connectResp[:])
-	if err != nil {
+	var connectResp [3]byte
+	if _, err := io.ReadFull(sock, connectResp[:]); err != nil {
 		return nil, nil, err
 	}
-	fmt.Printf("Received connect response: %v\n", connectResp[:n])
-
-	// expect
 	if connectResp[0] != 5 { // SOCKS version
 		return nil, nil, fmt.Errorf("unexpected version in connect: %d, wanted 5", connectResp[0])
 	}
 	if connectResp[1] != 0 { // "request granted"
-		return nil, nil, fmt.Errorf("unexpected status in connect: %d, wanted 0", connectResp[1])
+		return nil, nil, fmt.Errorf("UDP ASSOCIATE failed: %s", socks5.ReplyText(connectResp[1]))
 	}
-	addr, err := decodeHostPort(connectResp[3:])
+	bound, err := socks5.ReadAddr(sock)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to decode host in connect response: %v", err)
 	}
 
-	if addr.IP == nil || addr.IP.IsUnspecified() {
+	var addr *net.UDPAddr
+	if bound.IP == nil {
+		addr, err = net.ResolveUDPAddr("udp", bound.String())
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve relay address %s: %v", bound, err)
+		}
+	} else {
+		addr = &net.UDPAddr{IP: bound.IP, Port: bound.Port}
+	}
+	if addr.IP.IsUnspecified() {
 		addr.IP = proxyAddr.IP
 	}
 
 	return sock, addr, nil
 }
 
-func sizeOfHostPort(addr *net.UDPAddr) int {
-	return 7
-}
-
-func writeHostPort(buf []byte, addr *net.UDPAddr) {
-	if ip := addr.IP.To4(); ip != nil {
-		buf[0] = 1 // ipv4 (1=IPv4 address, 3=domain name, 4=IPv6 address)
-		buf[1] = ip[0]
-		buf[2] = ip[1]
-		buf[3] = ip[2]
-		buf[4] = ip[3]
-	} else if ip := addr.IP.To16(); ip != nil {
-		buf[0] = 4 // ipv6 (1=IPv4 address, 3=domain name, 4=IPv6 address)
-		copy(buf[1:], ip[:16])
+// authenticateSOCKS does the RFC 1929 username/password subnegotiation.
+func authenticateSOCKS(sock *net.TCPConn, proxy SOCKSProxy) error {
+	req := make([]byte, 0, 3+len(proxy.Username)+len(proxy.Password))
+	req = append(req, 1) // subnegotiation version
+	req = append(req, byte(len(proxy.Username)))
+	req = append(req, proxy.Username...)
+	req = append(req, byte(len(proxy.Password)))
+	req = append(req, proxy.Password...)
+	if _, err := sock.Write(req); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(sock, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != 1 {
+		return fmt.Errorf("unexpected subnegotiation version in authentication response: %d, wanted 1", resp[0])
+	}
+	if resp[1] != 0 {
+		return fmt.Errorf("%w: username %q, status %d", ErrSOCKSAuthRejected, proxy.Username, resp[1])
 	}
-	buf[5] = byte((addr.Port >> 8) & 255)
-	buf[6] = byte(addr.Port & 255)
+	return nil
 }
 
-func decodeHostPort(b []byte) (*net.UDPAddr, error) {
-	var ip net.IP
-	switch b[0] {
-	case 1: // IPv4
-		ip = net.IPv4(b[1], b[2], b[3], b[4])
-		b = b[5:]
-	case 4: // IPv6
-		ip := make(net.IP, 16)
-		copy(ip, b[1:17])
-		b = b[17:]
-	default:
-		return nil, fmt.Errorf("address type should be 1 or 4, was %d", b[0])
+// socksTarget returns the address for our UDP headers. With remoteDNS,
+// hostnames are left to the proxy.
+func socksTarget(targetAddr string, remoteDNS bool) (socks5.Addr, error) {
+	host, portStr, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return socks5.Addr{}, err
 	}
-	port := (int(b[0]) << 8) + int(b[1])
-	return &net.UDPAddr{IP: ip, Port: port}, nil
+	if ip := net.ParseIP(host); ip != nil || !remoteDNS {
+		addr, err := net.ResolveUDPAddr("udp", targetAddr)
+		if err != nil {
+			return socks5.Addr{}, err
+		}
+		return socks5.AddrFromUDP(addr), nil
+	}
+	port, err := net.LookupPort("udp", portStr)
+	if err != nil {
+		return socks5.Addr{}, err
+	}
+	a := socks5.Addr{Host: host, Port: port}
+	return a, a.Validate()
 }
 
-func NewUDPOverSocks(proxyAddr, targetAddr string) (*UDPOverSocks, error) {
-	sock, err := net.ListenUDP("udp4", nil)
+const (
+	minSOCKSBackoff = 500 * time.Millisecond
+	maxSOCKSBackoff = time.Minute
+	// socksStableAfter is how long a control connection lasts before we reset
+	// the backoff.
+	socksStableAfter = 30 * time.Second
+)
+
+func NewUDPOverSocks(proxy SOCKSProxy, targetAddr string) (*UDPOverSocks, error) {
+	target, err := socksTarget(targetAddr, proxy.RemoteDNS)
 	if err != nil {
 		return nil, err
 	}
-	addr, err := net.ResolveUDPAddr("udp4", targetAddr)
+	sock, err := net.ListenUDP("udp", nil)
 	if err != nil {
 		return nil, err
 	}
 	u := &UDPOverSocks{
-		udpConn:    sock,
-		proxyAddr:  proxyAddr,
-		targetAddr: addr,
-	}
-	go func() {
-		var b [100]byte
-		for {
-			u.lastTCPError = u.connect()
-			if u.lastTCPError != nil {
-				log.Printf("Failed to connect to proxy: %v", u.lastTCPError)
-				time.Sleep(time.Second)
-				continue
-			}
-			// This should block until our connection dies.
-			var n int
-			n, u.lastTCPError = u.tcpConn.Read(b[:])
-			log.Printf("Unexpectedly received %v (%q)", b[:n], b[:n])
-			u.tcpConn.Close()
-			time.Sleep(time.Second)
-		}
-	}()
+		udpConn:     newBatchConn(sock),
+		proxy:       proxy,
+		targetAddr:  target,
+		readBuf:     make([]byte, 65536),
+		reassembler: socks5.NewReassembler(),
+	}
+	go u.run()
 	return u, nil
 }
 
 type UDPOverSocks struct {
-	tcpConn      net.Conn
-	lastTCPError error
-	udpConn      *net.UDPConn
-	proxyAddr    string
-	targetAddr   *net.UDPAddr
+	stateTracker
+
+	udpConn    *batchConn
+	proxy      SOCKSProxy
+	targetAddr socks5.Addr
+
+	mtx sync.Mutex
+	// tcpConn is the control connection, which keeps the association alive.
+	tcpConn net.Conn
+	// udpProxyAddr is the proxy's relay, nil without an association.
 	udpProxyAddr *net.UDPAddr
+	closed       bool
+
+	readBuf     []byte
+	reassembler *socks5.Reassembler
 }
 
-func (u *UDPOverSocks) connect() error {
-	if u.tcpConn != nil {
-		u.tcpConn.Close()
+func (u *UDPOverSocks) Transport() string {
+	return "socks"
+}
+
+// run keeps a UDP association with the proxy, reconnecting with backoff.
+func (u *UDPOverSocks) run() {
+	b := backoff{min: minSOCKSBackoff, max: maxSOCKSBackoff}
+	for {
+		u.mtx.Lock()
+		closed := u.closed
+		u.mtx.Unlock()
+		if closed {
+			return
+		}
+		u.setState(LinkConnecting, nil)
+		conn, err := u.connect()
+		if err != nil {
+			u.setState(LinkDown, err)
+			b.wait()
+			continue
+		}
+		u.setState(LinkUp, nil)
+		connected := time.Now()
+		// This should block until our connection dies.
+		var buf [100]byte
+		n, err := conn.Read(buf[:])
+		if err == nil {
+			err = fmt.Errorf("unexpectedly received %q on the control connection", buf[:n])
+		}
+		u.mtx.Lock()
 		u.tcpConn = nil
+		u.udpProxyAddr = nil
+		closed = u.closed
+		u.mtx.Unlock()
+		conn.Close()
+		if closed {
+			return
+		}
+		u.setState(LinkDown, fmt.Errorf("control connection to proxy %s died: %w", u.proxy, err))
+		if time.Since(connected) > socksStableAfter {
+			b.reset()
+		}
+		b.wait()
 	}
-	conn, addr, err := setupSOCKS(u.proxyAddr, u.targetAddr, u.udpConn.LocalAddr().(*net.UDPAddr))
+}
+
+func (u *UDPOverSocks) connect() (net.Conn, error) {
+	conn, addr, err := setupSOCKS(u.proxy, u.udpConn.LocalAddr().(*net.UDPAddr))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	u.tcpConn = conn
 	if err = conn.SetKeepAlive(true); err != nil {
-		return fmt.Errorf("SetKeepAlive: %v", err)
+		conn.Close()
+		return nil, fmt.Errorf("SetKeepAlive: %v", err)
 	}
 	if err = conn.SetKeepAlivePeriod(4 * time.Second); err != nil {
-		return fmt.Errorf("SetKeepAlivePeriod: %v", err)
+		conn.Close()
+		return nil, fmt.Errorf("SetKeepAlivePeriod: %v", err)
+	}
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if u.closed {
+		conn.Close()
+		return nil, net.ErrClosed
 	}
+	u.tcpConn = conn
 	u.udpProxyAddr = addr
-	return nil
+	return conn, nil
+}
+
+// relay returns the proxy's UDP relay address, or nil if we're not connected.
+func (u *UDPOverSocks) relay() *net.UDPAddr {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return u.udpProxyAddr
 }
 
+// Close tears down the association and stops reconnecting.
+func (u *UDPOverSocks) Close() error {
+	u.mtx.Lock()
+	u.closed = true
+	if u.tcpConn != nil {
+		u.tcpConn.Close()
+	}
+	u.mtx.Unlock()
+	return u.udpConn.Close()
+}
+
+// Write fails while there is no association.
 func (u *UDPOverSocks) Write(b []byte) (int, error) {
-	buf := make([]byte, len(b)+sizeOfHostPort(u.targetAddr)+3)
-	buf[0] = 0
-	buf[1] = 0
-	buf[2] = 0
-	writeHostPort(buf[3:], u.targetAddr)
-	copy(buf[3+sizeOfHostPort(u.targetAddr):], b)
-	n, err := u.udpConn.WriteToUDP(buf, u.udpProxyAddr)
-	n -= 10
-	if n < 0 {
-		n = 0
+	relay := u.relay()
+	if relay == nil {
+		return 0, errNotConnected
+	}
+	hdrLen := 3 + u.targetAddr.Size()
+	if u.proxy.FragmentSize > 0 && hdrLen+len(b) > u.proxy.FragmentSize {
+		return u.writeFragmented(b, hdrLen, relay)
 	}
-	return n, err
+	p := packet.Get(hdrLen + len(b))
+	buf := p.Bytes()
+	u.putHeader(buf, 0)
+	copy(buf[hdrLen:], b)
+	if err := u.udpConn.enqueue(p, relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
 }
 
-func (u *UDPOverSocks) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
-	n, _, err := u.udpConn.ReadFromUDP(b)
-	if err != nil {
-		return 0, nil, err
+// WriteBuffer is Write without copying: the SOCKS header goes in p's headroom.
+func (u *UDPOverSocks) WriteBuffer(p *packet.Buffer, _ *net.UDPAddr) error {
+	hdrLen := 3 + u.targetAddr.Size()
+	if p.Headroom() < hdrLen || p.Shared() || (u.proxy.FragmentSize > 0 && hdrLen+p.Len() > u.proxy.FragmentSize) {
+		_, err := u.Write(p.Bytes())
+		return err
 	}
-	if len(b) < 10 {
-		log.Printf("Unexpected socks encapsulated UDP packet: too short")
+	relay := u.relay()
+	if relay == nil {
+		return errNotConnected
 	}
-	if b[0] != 0 {
-		log.Printf("Unexpected socks encapsulated UDP packet: reserved0 should be 0, was %d", b[0])
+	u.putHeader(p.Prepend(hdrLen), 0)
+	err := u.udpConn.WriteBuffer(p, relay)
+	p.Consume(hdrLen)
+	return err
+}
+
+// putHeader writes the SOCKS UDP header for fragment frag to buf.
+func (u *UDPOverSocks) putHeader(buf []byte, frag byte) {
+	buf[0] = 0 // reserved
+	buf[1] = 0 // reserved
+	buf[2] = frag
+	u.targetAddr.Put(buf[3:])
+}
+
+func (u *UDPOverSocks) writeFragmented(b []byte, hdrLen int, relay *net.UDPAddr) (int, error) {
+	chunk := u.proxy.FragmentSize - hdrLen
+	if chunk <= 0 {
+		return 0, fmt.Errorf("fragment size %d doesn't leave room for the %d byte header", u.proxy.FragmentSize, hdrLen)
 	}
-	if b[1] != 0 {
-		log.Printf("Unexpected socks encapsulated UDP packet: reserved1 should be 0, was %d", b[1])
+	frags := (len(b) + chunk - 1) / chunk
+	if frags > 127 {
+		return 0, fmt.Errorf("packet of %d bytes needs %d fragments, at most 127 are possible", len(b), frags)
 	}
-	if b[2] != 0 { // Fragment number
-		log.Printf("Unexpected socks encapsulated UDP packet: fragment number should be 0, was %d", b[2])
+	written := 0
+	for i := 1; len(b) > 0; i++ {
+		n := chunk
+		if n > len(b) {
+			n = len(b)
+		}
+		p := packet.Get(hdrLen + n)
+		buf := p.Bytes()
+		frag := byte(i)
+		if n == len(b) {
+			frag |= socks5.FragEnd
+		}
+		u.putHeader(buf, frag)
+		copy(buf[hdrLen:], b[:n])
+		if err := u.udpConn.enqueue(p, relay); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
 	}
-	addr, err := decodeHostPort(b[3:])
+	return written, nil
+}
+
+// ReadFromUDP returns the next well formed, reassembled datagram from the
+// proxy.
+func (u *UDPOverSocks) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	payload, addr, err := u.readPacket()
 	if err != nil {
-		log.Printf("Unexpected socks encapsulated UDP packet: %v", err)
+		return 0, nil, err
+	}
+	return copy(b, payload), addr, nil
+}
+
+// ReadBatch is ReadFromUDP without copying the datagram out of our buffer.
+func (u *UDPOverSocks) ReadBatch(handle func(b []byte, addr *net.UDPAddr)) error {
+	payload, addr, err := u.readPacket()
+	if err != nil {
+		return err
+	}
+	handle(payload, addr)
+	return nil
+}
+
+// readPacket returns the next datagram. It's only valid until the next call.
+func (u *UDPOverSocks) readPacket() ([]byte, *net.UDPAddr, error) {
+	for {
+		n, from, err := u.udpConn.ReadFromUDP(u.readBuf)
+		if err != nil {
+			return nil, nil, err
+		}
+		p := u.readBuf[:n]
+		if relay := u.relay(); relay == nil || !(from.IP.Equal(relay.IP) && from.Port == relay.Port) {
+			metrSOCKSIgnoredPackets.With(prometheus.Labels{"proxy": u.proxy.Addr}).Inc()
+			continue
+		}
+		if n < 3 {
+			log.Printf("Unexpected socks encapsulated UDP packet: too short")
+			continue
+		}
+		if p[0] != 0 || p[1] != 0 {
+			log.Printf("Unexpected socks encapsulated UDP packet: reserved bytes should be 0, were %d and %d", p[0], p[1])
+			continue
+		}
+		addr, hdrLen, err := socks5.DecodeAddr(p[3:])
+		if err != nil {
+			log.Printf("Unexpected socks encapsulated UDP packet: %v", err)
+			continue
+		}
+		payload, complete := u.reassembler.Add(p[2], p[3+hdrLen:])
+		if !complete {
+			continue
+		}
+		return payload, &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
 	}
-	n -= 10
-	copy(b, b[10:])
-	return n, addr, nil
 }
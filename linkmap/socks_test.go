@@ -0,0 +1,427 @@
+package linkmap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jille/bindlink/packet"
+	"github.com/Jille/bindlink/socks5"
+)
+
+// fakeSOCKS is a SOCKS5 proxy that only does the handshake. The test itself
+// uses relay.
+type fakeSOCKS struct {
+	username string
+	password string
+	l        net.Listener
+	relay    *net.UDPConn
+}
+
+func newFakeSOCKS(tb testing.TB, username, password string) *fakeSOCKS {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := &fakeSOCKS{
+		username: username,
+		password: password,
+		l:        l,
+		relay:    relay,
+	}
+	tb.Cleanup(func() {
+		l.Close()
+		relay.Close()
+	})
+	go s.serve()
+	return s
+}
+
+func (s *fakeSOCKS) proxy() SOCKSProxy {
+	return SOCKSProxy{
+		Addr:     s.l.Addr().String(),
+		Username: s.username,
+		Password: s.password,
+	}
+}
+
+func (s *fakeSOCKS) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if s.handshake(conn) {
+				io.Copy(io.Discard, conn)
+			}
+		}()
+	}
+}
+
+// handshake returns whether the client got its association.
+func (s *fakeSOCKS) handshake(conn net.Conn) bool {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return false
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return false
+	}
+	want := byte(0)
+	if s.username != "" {
+		want = 2
+	}
+	if bytes.IndexByte(methods, want) == -1 {
+		conn.Write([]byte{5, 0xff})
+		return false
+	}
+	conn.Write([]byte{5, want})
+	if want == 2 {
+		var ver [2]byte
+		if _, err := io.ReadFull(conn, ver[:]); err != nil {
+			return false
+		}
+		user := make([]byte, ver[1])
+		if _, err := io.ReadFull(conn, user); err != nil {
+			return false
+		}
+		var plen [1]byte
+		if _, err := io.ReadFull(conn, plen[:]); err != nil {
+			return false
+		}
+		pass := make([]byte, plen[0])
+		if _, err := io.ReadFull(conn, pass); err != nil {
+			return false
+		}
+		if string(user) != s.username || string(pass) != s.password {
+			conn.Write([]byte{1, 1})
+			return false
+		}
+		conn.Write([]byte{1, 0})
+	}
+	var req [3]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return false
+	}
+	if _, err := socks5.ReadAddr(conn); err != nil {
+		return false
+	}
+	bound := socks5.AddrFromUDP(s.relay.LocalAddr().(*net.UDPAddr))
+	resp := make([]byte, 3+bound.Size())
+	resp[0] = 5
+	bound.Put(resp[3:])
+	_, err := conn.Write(resp)
+	return err == nil
+}
+
+// waitForState waits until u is in state want and returns its last error.
+func waitForState(tb testing.TB, u *UDPOverSocks, want LinkState) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, err := u.State()
+		if state == want {
+			return err
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("SOCKS link is still %s, want %s (last error: %v)", state, want, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// read returns the next reassembled datagram from the client, its destination,
+// the number of fragments and the client's address.
+func (s *fakeSOCKS) read(t *testing.T) ([]byte, socks5.Addr, int, *net.UDPAddr) {
+	t.Helper()
+	r := socks5.NewReassembler()
+	buf := make([]byte, 65536)
+	s.relay.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for frags := 1; ; frags++ {
+		n, from, err := s.relay.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("relay didn't get a datagram: %v", err)
+		}
+		b := buf[:n]
+		if len(b) < 3 || b[0] != 0 || b[1] != 0 {
+			t.Fatalf("relay got datagram with a bad header: %x", b)
+		}
+		dst, hdrLen, err := socks5.DecodeAddr(b[3:])
+		if err != nil {
+			t.Fatalf("relay got datagram with a bad address: %v", err)
+		}
+		if payload, complete := r.Add(b[2], b[3+hdrLen:]); complete {
+			return append([]byte(nil), payload...), dst, frags, from
+		}
+	}
+}
+
+// write sends payload from src to the client, in fragments if fragSize is set.
+func (s *fakeSOCKS) write(t *testing.T, to *net.UDPAddr, src socks5.Addr, payload []byte, fragSize int) {
+	t.Helper()
+	whole := fragSize == 0
+	if whole {
+		fragSize = len(payload)
+	}
+	for i := 1; len(payload) > 0; i++ {
+		n := fragSize
+		if n > len(payload) {
+			n = len(payload)
+		}
+		frag := byte(i)
+		if n == len(payload) {
+			frag |= socks5.FragEnd
+		}
+		if whole {
+			frag = 0
+		}
+		b := make([]byte, 3+src.Size(), 3+src.Size()+n)
+		b[2] = frag
+		src.Put(b[3:])
+		if _, err := s.relay.WriteToUDP(append(b, payload[:n]...), to); err != nil {
+			t.Fatal(err)
+		}
+		payload = payload[n:]
+	}
+}
+
+func TestUDPOverSocks(t *testing.T) {
+	payload := bytes.Repeat([]byte("bindlink"), 400)
+	for _, tc := range []struct {
+		name string
+		// What the proxy wants, and what we give it.
+		serverUser, serverPass string
+		user, pass             string
+		target                 string
+		remoteDNS              bool
+		fragmentSize           int
+		wantTarget             string
+		wantFrags              int
+		wantErr                error
+	}{
+		{
+			name:       "no auth",
+			target:     "127.0.0.1:4000",
+			wantTarget: "127.0.0.1:4000",
+			wantFrags:  1,
+		},
+		{
+			name:       "username and password",
+			serverUser: "user",
+			serverPass: "secret",
+			user:       "user",
+			pass:       "secret",
+			target:     "127.0.0.1:4000",
+			wantTarget: "127.0.0.1:4000",
+			wantFrags:  1,
+		},
+		{
+			name:       "wrong password",
+			serverUser: "user",
+			serverPass: "secret",
+			user:       "user",
+			pass:       "guess",
+			target:     "127.0.0.1:4000",
+			wantErr:    ErrSOCKSAuthRejected,
+		},
+		{
+			name:       "no credentials",
+			serverUser: "user",
+			serverPass: "secret",
+			target:     "127.0.0.1:4000",
+			wantErr:    ErrSOCKSAuthRejected,
+		},
+		{
+			name:       "IPv6 target",
+			target:     "[2001:db8::1]:4000",
+			wantTarget: "[2001:db8::1]:4000",
+			wantFrags:  1,
+		},
+		{
+			name:       "remote DNS",
+			target:     "bindlink.example:4000",
+			remoteDNS:  true,
+			wantTarget: "bindlink.example:4000",
+			wantFrags:  1,
+		},
+		{
+			name:         "fragmented",
+			target:       "127.0.0.1:4000",
+			fragmentSize: 1024,
+			wantTarget:   "127.0.0.1:4000",
+			wantFrags:    4,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFakeSOCKS(t, tc.serverUser, tc.serverPass)
+			proxy := s.proxy()
+			proxy.Username = tc.user
+			proxy.Password = tc.pass
+			proxy.RemoteDNS = tc.remoteDNS
+			proxy.FragmentSize = tc.fragmentSize
+			u, err := NewUDPOverSocks(proxy, tc.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+
+			type change struct {
+				state LinkState
+				err   error
+			}
+			changes := make(chan change, 100)
+			u.watchState(func(state LinkState, err error) {
+				select {
+				case changes <- change{state, err}:
+				default:
+				}
+			})
+			defer u.watchState(nil)
+		wait:
+			for {
+				select {
+				case c := <-changes:
+					if tc.wantErr != nil && c.err != nil {
+						if c.state != LinkDown || !errors.Is(c.err, tc.wantErr) {
+							t.Fatalf("link is %s with error %v, want down with %v", c.state, c.err, tc.wantErr)
+						}
+						return
+					}
+					if c.err != nil {
+						t.Fatalf("link is %s: %v", c.state, c.err)
+					}
+					if c.state == LinkUp {
+						if tc.wantErr != nil {
+							t.Fatalf("link is up, want error %v", tc.wantErr)
+						}
+						break wait
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("link didn't come up or fail in time")
+				}
+			}
+
+			if _, err := u.Write(payload); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			got, dst, frags, client := s.read(t)
+			if !bytes.Equal(got, payload) {
+				t.Errorf("relay got %d bytes, want the %d we sent", len(got), len(payload))
+			}
+			if dst.String() != tc.wantTarget {
+				t.Errorf("relay got datagram for %s, want %s", dst, tc.wantTarget)
+			}
+			if frags != tc.wantFrags {
+				t.Errorf("relay got %d fragments, want %d", frags, tc.wantFrags)
+			}
+
+			src := socks5.Addr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+			s.write(t, client, src, payload, tc.fragmentSize/2)
+			buf := make([]byte, 65536)
+			n, from, err := u.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatalf("ReadFromUDP: %v", err)
+			}
+			if !bytes.Equal(buf[:n], payload) {
+				t.Errorf("ReadFromUDP returned %d bytes, want the %d the relay sent", n, len(payload))
+			}
+			if from.String() != src.String() {
+				t.Errorf("ReadFromUDP returned a datagram from %s, want %s", from, src)
+			}
+		})
+	}
+}
+
+// TestSOCKSServer runs UDPOverSocks against our own SOCKS server.
+func TestSOCKSServer(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go (&socks5.Server{Username: "user", Password: "secret"}).Serve(l)
+
+	payload := bytes.Repeat([]byte("bindlink"), 400)
+	for _, tc := range []struct {
+		name         string
+		password     string
+		fragmentSize int
+		wantErr      error
+	}{
+		{name: "ok", password: "secret"},
+		{name: "fragmented", password: "secret", fragmentSize: 1024},
+		{name: "wrong password", password: "guess", wantErr: ErrSOCKSAuthRejected},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := SOCKSProxy{
+				Addr:         l.Addr().String(),
+				Username:     "user",
+				Password:     tc.password,
+				FragmentSize: tc.fragmentSize,
+			}
+			u, err := NewUDPOverSocks(proxy, echo.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+			if tc.wantErr != nil {
+				if err := waitForState(t, u, LinkDown); !errors.Is(err, tc.wantErr) {
+					t.Fatalf("link is down with error %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			waitForState(t, u, LinkUp)
+			if _, err := u.Write(payload); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			buf := make([]byte, 65536)
+			n, _, err := u.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatalf("ReadFromUDP: %v", err)
+			}
+			if !bytes.Equal(buf[:n], payload) {
+				t.Errorf("ReadFromUDP returned %d bytes, want the %d we sent", n, len(payload))
+			}
+		})
+	}
+}
+
+func TestSendOverDownLink(t *testing.T) {
+	s := newFakeSOCKS(t, "user", "secret")
+	proxy := s.proxy()
+	proxy.Password = "guess"
+	lm, _ := newBenchMap(t)
+	if err := lm.InitiateLinkOverSOCKS(proxy, "127.0.0.1:4000"); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, lm.lookup(1).path.Load().sock.(*UDPOverSocks), LinkDown)
+	p := packet.Get(100)
+	defer p.Release()
+	if err := lm.Send(1, p); err != nil {
+		t.Errorf("Send over a link that is down: %v, want the packet dropped", err)
+	}
+}
@@ -0,0 +1,150 @@
+package linkmap
+
+import (
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metrLinkState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "link_state",
+			Help: "State of links that need a connection before they can carry packets, always 1",
+		},
+		[]string{"link", "state"})
+	metrLinkErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "link_errors",
+			Help: "Number of times the connection of a link failed or couldn't be set up, and packets that couldn't be sent over it",
+		},
+		[]string{"link"})
+)
+
+// LinkState is how far a link is in setting up its connection.
+type LinkState int
+
+const (
+	LinkConnecting LinkState = iota
+	LinkUp
+	LinkDown
+)
+
+func (s LinkState) String() string {
+	switch s {
+	case LinkConnecting:
+		return "connecting"
+	case LinkUp:
+		return "up"
+	case LinkDown:
+		return "down"
+	}
+	return "unknown"
+}
+
+// stateTracker is embedded in links with a LinkState.
+type stateTracker struct {
+	stateMtx sync.Mutex
+	state    LinkState
+	lastErr  error
+	onChange func(LinkState, error)
+}
+
+// setState moves to state. err is why, if something went wrong.
+func (t *stateTracker) setState(state LinkState, err error) {
+	t.stateMtx.Lock()
+	changed := state != t.state
+	t.state = state
+	if err != nil {
+		t.lastErr = err
+	}
+	cb := t.onChange
+	t.stateMtx.Unlock()
+	if cb != nil && (changed || err != nil) {
+		cb(state, err)
+	}
+}
+
+// State returns the current state and the last error that occurred.
+func (t *stateTracker) State() (LinkState, error) {
+	t.stateMtx.Lock()
+	defer t.stateMtx.Unlock()
+	return t.state, t.lastErr
+}
+
+// watchState calls cb now and on every change. A nil cb stops watching.
+func (t *stateTracker) watchState(cb func(LinkState, error)) {
+	t.stateMtx.Lock()
+	t.onChange = cb
+	state := t.state
+	t.stateMtx.Unlock()
+	if cb != nil {
+		cb(state, nil)
+	}
+}
+
+type stateWatcher interface {
+	watchState(cb func(LinkState, error))
+}
+
+// watchLinkState keeps the multiplexer and metrics up to date with the state of
+// sock, if it has one.
+func (lm *Map) watchLinkState(linkId int, sock UDPLikeConn) {
+	w, ok := sock.(stateWatcher)
+	if !ok {
+		return
+	}
+	link := strconv.Itoa(linkId)
+	w.watchState(func(state LinkState, err error) {
+		if err != nil {
+			log.Printf("Link %d is %s: %v", linkId, state, err)
+			metrLinkErrors.With(prometheus.Labels{"link": link}).Inc()
+		} else if state != LinkConnecting {
+			// Connecting happens on every retry, which would be too noisy.
+			log.Printf("Link %d is %s", linkId, state)
+		}
+		metrLinkState.DeletePartialMatch(prometheus.Labels{"link": link})
+		metrLinkState.With(prometheus.Labels{"link": link, "state": state.String()}).Set(1)
+		lm.mp.SetLinkUp(linkId, state == LinkUp)
+	})
+}
+
+func (lm *Map) unwatchLinkState(linkId int, sock UDPLikeConn) {
+	if w, ok := sock.(stateWatcher); ok {
+		w.watchState(nil)
+		metrLinkState.DeletePartialMatch(prometheus.Labels{"link": strconv.Itoa(linkId)})
+	}
+}
+
+// backoff is exponential backoff with jitter for reconnect loops.
+type backoff struct {
+	min, max time.Duration
+	cur      time.Duration
+}
+
+// next returns the next backoff period, with jitter.
+func (b *backoff) next() time.Duration {
+	if b.cur < b.min {
+		b.cur = b.min
+	}
+	d := b.cur/2 + time.Duration(rand.Int63n(int64(b.cur/2)+1))
+	b.cur *= 2
+	if b.cur > b.max {
+		b.cur = b.max
+	}
+	return d
+}
+
+// wait sleeps for the next backoff period.
+func (b *backoff) wait() {
+	time.Sleep(b.next())
+}
+
+func (b *backoff) reset() {
+	b.cur = b.min
+}
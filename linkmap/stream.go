@@ -0,0 +1,289 @@
+package linkmap
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Jille/bindlink/packet"
+)
+
+// streamWriteTimeout keeps a stuck stream from stalling the tun reader.
+const streamWriteTimeout = 5 * time.Second
+
+var errNotConnected = errors.New("not connected")
+
+const (
+	minStreamBackoff = 500 * time.Millisecond
+	maxStreamBackoff = time.Minute
+	// streamStableAfter is how long a stream lasts before we reset the backoff.
+	streamStableAfter = 30 * time.Second
+)
+
+// streamLink is a UDPLikeConn over a connection that breaks for good.
+type streamLink interface {
+	UDPLikeConn
+	Transport() string
+	Close() error
+}
+
+// streamConn carries packets over a byte stream, each prefixed with its length
+// as a big endian uint16.
+type streamConn struct {
+	conn      net.Conn
+	r         io.Reader
+	remote    *net.UDPAddr
+	transport string
+
+	wmtx sync.Mutex
+}
+
+// newStreamConn wraps conn. Reads go through r, which may have buffered part of
+// the stream.
+func newStreamConn(conn net.Conn, r io.Reader, transport string) *streamConn {
+	s := &streamConn{
+		conn:      conn,
+		r:         r,
+		transport: transport,
+	}
+	if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		s.remote = &net.UDPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+	}
+	return s
+}
+
+func (s *streamConn) Write(b []byte) (int, error) {
+	if len(b) > 65535 {
+		return 0, fmt.Errorf("packet of %d bytes is too large for a stream link", len(b))
+	}
+	p := packet.Get(2 + len(b))
+	defer p.Release()
+	buf := p.Bytes()
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	s.wmtx.Lock()
+	defer s.wmtx.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	if _, err := s.conn.Write(buf); err != nil {
+		// A partial write breaks the framing.
+		s.conn.Close()
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFromUDP returns io.EOF once the stream ends, even mid-packet.
+func (s *streamConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, nil, err
+		}
+		n := int(binary.BigEndian.Uint16(hdr[:]))
+		if n > len(b) {
+			log.Printf("Skipping packet of %d bytes from %s, our buffer is only %d bytes", n, s.remote, len(b))
+			if _, err := io.CopyN(io.Discard, s.r, int64(n)); err != nil {
+				return 0, nil, io.EOF
+			}
+			continue
+		}
+		if _, err := io.ReadFull(s.r, b[:n]); err != nil {
+			return 0, nil, io.EOF
+		}
+		return n, s.remote, nil
+	}
+}
+
+func (s *streamConn) Transport() string {
+	return s.transport
+}
+
+func (s *streamConn) Close() error {
+	return s.conn.Close()
+}
+
+// StartTCPListener accepts links over TCP on port.
+func (lm *Map) StartTCPListener(port int) error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	lm.acceptStreams(l, "tcp")
+	return nil
+}
+
+// acceptStreams serves stream links accepted from l in the background.
+func (lm *Map) acceptStreams(l net.Listener, transport string) {
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Printf("Accepting %s link failed: %v", transport, err)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			go func() {
+				sc := newStreamConn(conn, conn, transport)
+				if tc, ok := conn.(*tls.Conn); ok {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					err := tc.HandshakeContext(ctx)
+					cancel()
+					if err != nil {
+						log.Printf("TLS handshake with %s failed: %v", sc.remote, err)
+						conn.Close()
+						return
+					}
+				}
+				lm.handleStream(sc, sc.remote)
+			}()
+		}
+	}()
+}
+
+// handleStream reads from an accepted stream until it breaks. Like on the UDP
+// listener, link ids are learned from the packets.
+func (lm *Map) handleStream(sc streamLink, remote *net.UDPAddr) {
+	defer sc.Close()
+	log.Printf("Accepted %s link from %s", sc.Transport(), remote)
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := sc.ReadFromUDP(buf)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("%s link from %s failed: %v", sc.Transport(), remote, err)
+			} else {
+				log.Printf("%s link from %s closed", sc.Transport(), remote)
+			}
+			return
+		}
+		lm.handlePacket(-1, sc, addr, buf[:n])
+	}
+}
+
+// redialingStream is an outgoing stream link that redials when it breaks.
+type redialingStream struct {
+	stateTracker
+
+	desc      string
+	transport string
+	dial      func() (streamLink, error)
+
+	// backoff is only used by the reader.
+	backoff backoff
+
+	mtx       sync.Mutex
+	conn      streamLink
+	connected time.Time
+	closed    bool
+}
+
+func newRedialingStream(desc, transport string, dial func() (streamLink, error)) *redialingStream {
+	return &redialingStream{
+		desc:      desc,
+		transport: transport,
+		dial:      dial,
+		backoff:   backoff{min: minStreamBackoff, max: maxStreamBackoff},
+	}
+}
+
+// Write fails while the stream is down.
+func (s *redialingStream) Write(b []byte) (int, error) {
+	s.mtx.Lock()
+	conn := s.conn
+	s.mtx.Unlock()
+	if conn == nil {
+		return 0, errNotConnected
+	}
+	n, err := conn.Write(b)
+	if err != nil {
+		s.drop(conn)
+	}
+	return n, err
+}
+
+// ReadFromUDP (re)connects as needed and only returns with a packet.
+func (s *redialingStream) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		s.mtx.Lock()
+		conn, closed := s.conn, s.closed
+		s.mtx.Unlock()
+		if closed {
+			return 0, nil, net.ErrClosed
+		}
+		if conn == nil {
+			s.setState(LinkConnecting, nil)
+			var err error
+			conn, err = s.dial()
+			if err != nil {
+				s.setState(LinkDown, fmt.Errorf("failed to connect to %s: %w", s.desc, err))
+				s.backoff.wait()
+				continue
+			}
+			s.mtx.Lock()
+			if s.closed {
+				s.mtx.Unlock()
+				conn.Close()
+				return 0, nil, net.ErrClosed
+			}
+			s.conn = conn
+			s.connected = time.Now()
+			s.mtx.Unlock()
+			s.setState(LinkUp, nil)
+		}
+		n, addr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			s.drop(conn)
+			s.mtx.Lock()
+			closed, stable := s.closed, time.Since(s.connected) > streamStableAfter
+			s.mtx.Unlock()
+			if closed {
+				return 0, nil, net.ErrClosed
+			}
+			s.setState(LinkDown, fmt.Errorf("stream to %s broke: %w", s.desc, err))
+			if stable {
+				s.backoff.reset()
+			}
+			s.backoff.wait()
+			continue
+		}
+		return n, addr, nil
+	}
+}
+
+// Close tears down the stream and stops reconnecting.
+func (s *redialingStream) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.closed = true
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return nil
+}
+
+func (s *redialingStream) Transport() string {
+	return s.transport
+}
+
+// drop closes conn and forgets about it, unless it was already replaced.
+func (s *redialingStream) drop(conn streamLink) {
+	conn.Close()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.conn == conn {
+		s.conn = nil
+	}
+}
@@ -0,0 +1,69 @@
+package linkmap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+var (
+	tlsCA       = flag.String("tls_ca", "", "PEM file with the CA certificates to verify the master's TLS certificate with (defaults to the system roots)")
+	tlsInsecure = flag.Bool("tls_insecure_skip_verify", false, "Don't verify the master's TLS certificate")
+)
+
+// We advertise HTTP/1.1 like a browser, so links on port 443 look like HTTPS.
+var tlsNextProtos = []string{"http/1.1"}
+
+func clientTLSConfig(serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		ServerName:         serverName,
+		NextProtos:         tlsNextProtos,
+		InsecureSkipVerify: *tlsInsecure,
+	}
+	if *tlsCA != "" {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *tlsCA)
+		}
+	}
+	return cfg, nil
+}
+
+// dialStream connects to target over TCP, wrapped in TLS if transport is "tls".
+func dialStream(transport, target string, tlsConfig *tls.Config, opts linkOptions) (*streamConn, error) {
+	d := opts.tcpDialer()
+	if transport == "tls" {
+		conn, err := tls.DialWithDialer(d, "tcp", target, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return newStreamConn(conn, conn, transport), nil
+	}
+	conn, err := d.Dial("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamConn(conn, conn, transport), nil
+}
+
+// StartTLSListener accepts links over TLS 1.3 on port.
+func (lm *Map) StartTLSListener(port int, cert tls.Certificate) error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	lm.acceptStreams(tls.NewListener(l, &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   tlsNextProtos,
+	}), "tls")
+	return nil
+}
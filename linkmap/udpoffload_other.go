@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package linkmap
+
+import "net"
+
+// enableUDPOffload reports that GSO and GRO are Linux only.
+func enableUDPOffload(c *net.UDPConn) (gso, gro bool) {
+	return false, false
+}
+
+func groSegmentSize(oob []byte) int {
+	return 0
+}
+
+func gsoControl(b []byte, size int) []byte {
+	return nil
+}
+
+func gsoUnsupported(err error) bool {
+	return false
+}
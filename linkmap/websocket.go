@@ -0,0 +1,136 @@
+package linkmap
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConn carries a packet per binary WebSocket message.
+type wsConn struct {
+	conn   *websocket.Conn
+	remote *net.UDPAddr
+
+	wmtx sync.Mutex
+	// extra is used by ReadFromUDP to check whether a message fit.
+	extra [1]byte
+}
+
+func newWSConn(conn *websocket.Conn, remote string) *wsConn {
+	c := &wsConn{conn: conn}
+	if host, port, err := net.SplitHostPort(remote); err == nil {
+		p, _ := net.LookupPort("tcp", port)
+		c.remote = &net.UDPAddr{IP: net.ParseIP(host), Port: p}
+	}
+	return c
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		c.conn.Close()
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFromUDP returns the next binary message, or io.EOF after a clean close.
+func (c *wsConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		mt, r, err := c.conn.NextReader()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, nil, io.EOF
+			}
+			return 0, nil, err
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+		n, err := io.ReadFull(r, b)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return n, c.remote, nil
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		// The message might be exactly as large as b. ReadFull keeps reading
+		// through empty reads, like the rest of a fragmented message.
+		switch _, err := io.ReadFull(r, c.extra[:]); err {
+		case io.EOF:
+			return n, c.remote, nil
+		case nil:
+			log.Printf("Skipping WebSocket message from %s larger than our %d byte buffer", c.remote, len(b))
+		default:
+			return 0, nil, err
+		}
+	}
+}
+
+func (c *wsConn) Transport() string {
+	return "websocket"
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  16384,
+	WriteBufferSize: 16384,
+	// Our peers aren't browsers.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// WebSocketHandler accepts links over WebSocket, e.g. behind an HTTPS reverse
+// proxy.
+func (lm *Map) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("WebSocket upgrade from %s failed: %v", r.RemoteAddr, err)
+			return
+		}
+		c := newWSConn(conn, r.RemoteAddr)
+		lm.handleStream(c, c.remote)
+	})
+}
+
+// dialWebSocket connects to a ws:// or wss:// URL, through the proxy from the
+// environment.
+func dialWebSocket(target string, opts linkOptions) (streamLink, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	d := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 10 * time.Second,
+		ReadBufferSize:   16384,
+		WriteBufferSize:  16384,
+		NetDial:          opts.tcpDialer().Dial,
+	}
+	if u.Scheme == "wss" {
+		d.TLSClientConfig, err = clientTLSConfig(u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn, resp, err := d.Dial(target, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%v (HTTP status %s)", err, resp.Status)
+		}
+		return nil, err
+	}
+	return newWSConn(conn, conn.RemoteAddr().String()), nil
+}
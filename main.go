@@ -1,9 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"log"
 	"net/http"
+	"os"
 	"strings"
 
 	_ "net/http/pprof"
@@ -16,13 +18,29 @@ import (
 
 var (
 	listenPort  = flag.Int("listen_port", 0, "Listen for incoming connections on this port")
+	listenTCP   = flag.Int("listen_tcp_port", 0, "Listen for incoming links encapsulated in TCP (e.g. through HTTP proxies) on this port")
+	listenTLS   = flag.Int("listen_tls_port", 0, "Listen for incoming links encapsulated in TLS on this port")
+	listenWS    = flag.String("listen_websocket", "", "Listen on this address for incoming links carried over WebSocket, using TLS if --tls_cert is set")
+	wsPath      = flag.String("websocket_path", "/bindlink", "HTTP path to accept WebSocket links on")
+	tlsCert     = flag.String("tls_cert", "", "PEM file with the certificate for --listen_tls_port and --listen_websocket")
+	tlsKey      = flag.String("tls_key", "", "PEM file with the private key for --listen_tls_port and --listen_websocket")
 	httpAddr    = flag.String("http_listen_port", ":8080", "Listen on this address for stats")
-	targets     = flag.String("targets", "", "Host:port pairs of direct endpoints to connect to")
-	proxies     = flag.String("proxies", "", "Host:port pairs of proxy servers")
+	targets     = flag.String("targets", "", "Host:port pairs of direct endpoints to connect to, optionally prefixed with tcp:// or tls:// to use a stream instead of UDP, or ws:// or wss:// URLs to use WebSocket. Append ;src=<ip>, ;dev=<interface> or ;mark=<fwmark> to pick the local uplink and ;keepalive=<duration|auto> for minimal keepalives")
+	proxies     = flag.String("proxies", "", "Host:port pairs of proxy servers, optionally prefixed with user:pass@ for SOCKS authentication")
 	proxyTarget = flag.String("proxy_target", "", "Host:port pair to have proxy servers connect to")
+	remoteDNS   = flag.Bool("proxy_remote_dns", false, "Let the proxy servers resolve the hostname in --proxy_target instead of resolving it locally")
+	proxyFrag   = flag.Int("proxy_fragment_size", 0, "Split UDP datagrams to the proxy servers that are larger than this using SOCKS fragmentation (0 to disable)")
+	discoverIfs = flag.String("discover_interfaces", "", "Comma separated patterns (e.g. usb*,wwan*) of network interfaces to automatically create links over while they have an IPv4 address and default route")
+	discoverTo  = flag.String("discover_target", "", "Target like in --targets for links over --discover_interfaces (defaults to --proxy_target)")
+	httpProxies = flag.String("http_proxies", "", "Host:port pairs of HTTP proxies that support CONNECT, optionally prefixed with user:pass@ for basic authentication")
+	httpTarget  = flag.String("http_proxy_target", "", "Host:port pair of the master's --listen_tcp_port to have HTTP proxies connect to (defaults to --proxy_target)")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "socks-server" {
+		socksServerMain(os.Args[2:])
+		return
+	}
 	flag.Parse()
 
 	http.Handle("/metrics", promhttp.Handler())
@@ -30,7 +48,7 @@ func main() {
 		log.Fatal(http.ListenAndServe(*httpAddr, nil))
 	}()
 
-	isMaster := *listenPort > 0
+	isMaster := *listenPort > 0 || *listenTCP > 0 || *listenTLS > 0 || *listenWS != ""
 	tun, err := tundev.New(isMaster)
 	if err != nil {
 		log.Fatalf("Failed to create TUN device: %v", err)
@@ -42,6 +60,30 @@ func main() {
 			log.Fatalf("Failed to start listening socket: %v", err)
 		}
 	}
+	if *listenTCP > 0 {
+		if err := lm.StartTCPListener(*listenTCP); err != nil {
+			log.Fatalf("Failed to start listening TCP socket: %v", err)
+		}
+	}
+	if *listenTLS > 0 {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		if err := lm.StartTLSListener(*listenTLS, cert); err != nil {
+			log.Fatalf("Failed to start listening TLS socket: %v", err)
+		}
+	}
+	if *listenWS != "" {
+		mux := http.NewServeMux()
+		mux.Handle(*wsPath, lm.WebSocketHandler())
+		go func() {
+			if *tlsCert != "" {
+				log.Fatal(http.ListenAndServeTLS(*listenWS, *tlsCert, *tlsKey, mux))
+			}
+			log.Fatal(http.ListenAndServe(*listenWS, mux))
+		}()
+	}
 	for _, p := range strings.Split(*targets, ",") {
 		if p == "" {
 			continue
@@ -54,8 +96,37 @@ func main() {
 		if p == "" {
 			continue
 		}
-		if err := lm.InitiateLinkOverSOCKS(p, *proxyTarget); err != nil {
-			log.Fatalf("Failed to connect to peer %q: %v", p, err)
+		proxy, err := linkmap.ParseSOCKSProxy(p)
+		if err != nil {
+			log.Fatalf("Failed to parse proxy: %v", err)
+		}
+		proxy.RemoteDNS = *remoteDNS
+		proxy.FragmentSize = *proxyFrag
+		if err := lm.InitiateLinkOverSOCKS(proxy, *proxyTarget); err != nil {
+			log.Fatalf("Failed to connect to peer %s: %v", proxy, err)
+		}
+	}
+	if *httpTarget == "" {
+		*httpTarget = *proxyTarget
+	}
+	for _, p := range strings.Split(*httpProxies, ",") {
+		if p == "" {
+			continue
+		}
+		proxy, err := linkmap.ParseHTTPProxy(p)
+		if err != nil {
+			log.Fatalf("Failed to parse HTTP proxy: %v", err)
+		}
+		if err := lm.InitiateLinkOverHTTPProxy(proxy, *httpTarget); err != nil {
+			log.Fatalf("Failed to connect to peer %s: %v", proxy, err)
+		}
+	}
+	if *discoverIfs != "" {
+		if *discoverTo == "" {
+			*discoverTo = *proxyTarget
+		}
+		if err := lm.WatchInterfaces(strings.Split(*discoverIfs, ","), *discoverTo); err != nil {
+			log.Fatalf("Failed to watch network interfaces: %v", err)
 		}
 	}
 	mp.Start(tun.Send, lm.Send)
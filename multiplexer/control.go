@@ -0,0 +1,110 @@
+package multiplexer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// A control packet is the version followed by fields: a type byte, the length
+// as a uvarint, and the value. Unknown fields and trailing data in values are
+// skipped, so the version only changes if a field's meaning does.
+const controlVersion = 1
+
+const (
+	// fieldSeqNo holds the sequence number as a uvarint.
+	fieldSeqNo = 1
+	// fieldReceived holds a link id and its received bytes as uvarints, per
+	// link.
+	fieldReceived = 2
+)
+
+var errShortField = errors.New("control packet field is truncated")
+
+// MarshalBinary encodes p in the control packet format.
+func (p *ControlPacket) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, 8+len(p.Received)*8)
+	b = append(b, controlVersion)
+	var v [2 * binary.MaxVarintLen64]byte
+	b = appendField(b, fieldSeqNo, binary.AppendUvarint(v[:0], uint64(p.SeqNo)))
+	ids := make([]int, 0, len(p.Received))
+	for id := range p.Received {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		f := binary.AppendUvarint(v[:0], uint64(id))
+		f = binary.AppendUvarint(f, p.Received[id].Bytes)
+		b = appendField(b, fieldReceived, f)
+	}
+	return b, nil
+}
+
+func appendField(b []byte, typ byte, value []byte) []byte {
+	b = append(b, typ)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// UnmarshalBinary decodes a control packet. It doesn't trust b.
+func (p *ControlPacket) UnmarshalBinary(b []byte) error {
+	if len(b) == 0 {
+		return errors.New("empty control packet")
+	}
+	if b[0] != controlVersion {
+		return fmt.Errorf("control packet has version %d, we only know %d", b[0], controlVersion)
+	}
+	*p = ControlPacket{
+		Received: map[int]ReceivedEntry{},
+	}
+	haveSeqNo := false
+	b = b[1:]
+	for len(b) > 0 {
+		typ := b[0]
+		l, n := binary.Uvarint(b[1:])
+		if n <= 0 || l > uint64(len(b)-1-n) {
+			return errShortField
+		}
+		value := b[1+n : 1+n+int(l)]
+		b = b[1+n+int(l):]
+		switch typ {
+		case fieldSeqNo:
+			seq, _, err := readUvarint(value)
+			if err != nil {
+				return err
+			}
+			if seq > math.MaxInt32 {
+				return fmt.Errorf("control packet sequence number %d out of range", seq)
+			}
+			p.SeqNo = int(seq)
+			haveSeqNo = true
+		case fieldReceived:
+			id, rest, err := readUvarint(value)
+			if err != nil {
+				return err
+			}
+			bytes, _, err := readUvarint(rest)
+			if err != nil {
+				return err
+			}
+			if id > 255 {
+				return fmt.Errorf("control packet has stats for link %d, link ids are a byte", id)
+			}
+			p.Received[int(id)] = ReceivedEntry{Bytes: bytes}
+		}
+	}
+	if !haveSeqNo {
+		return errors.New("control packet has no sequence number")
+	}
+	return nil
+}
+
+func readUvarint(b []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, errShortField
+	}
+	return v, b[n:], nil
+}
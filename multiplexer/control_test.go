@@ -0,0 +1,131 @@
+package multiplexer
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// gobControlPacket is ControlPacket as it was when gob encoded.
+type gobControlPacket struct {
+	SeqNo    int
+	Received map[int]ReceivedEntry
+}
+
+// gobControl encodes p the way older versions sent control packets.
+func gobControl(tb testing.TB, p gobControlPacket) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(p); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var controlPackets = []ControlPacket{
+	{SeqNo: 0, Received: map[int]ReceivedEntry{}},
+	{SeqNo: 1, Received: map[int]ReceivedEntry{1: {Bytes: 0}}},
+	{SeqNo: 42, Received: map[int]ReceivedEntry{1: {Bytes: 1500}, 2: {Bytes: 3000000}, 255: {Bytes: 1}}},
+	{SeqNo: 1<<31 - 1, Received: map[int]ReceivedEntry{0: {Bytes: 1<<64 - 1}}},
+}
+
+func TestControlRoundTrip(t *testing.T) {
+	for _, want := range controlPackets {
+		b, err := want.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary(%+v): %v", want, err)
+		}
+		var got ControlPacket
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatalf("UnmarshalBinary(%x): %v", b, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("UnmarshalBinary(MarshalBinary(%+v)) = %+v", want, got)
+		}
+	}
+}
+
+func TestControlVersionMismatch(t *testing.T) {
+	b, err := controlPackets[2].MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []byte{0, controlVersion + 1, 255} {
+		b[0] = v
+		var p ControlPacket
+		if err := p.UnmarshalBinary(b); err == nil || !strings.Contains(err.Error(), "version") {
+			t.Errorf("UnmarshalBinary of version %d: got error %v, want a version mismatch", v, err)
+		}
+	}
+}
+
+func TestControlGob(t *testing.T) {
+	b := gobControl(t, gobControlPacket{SeqNo: 7, Received: map[int]ReceivedEntry{1: {Bytes: 100}}})
+	var p ControlPacket
+	if err := p.UnmarshalBinary(b); err == nil {
+		t.Errorf("UnmarshalBinary(%x) of a gob encoded packet = %+v, want an error", b, p)
+	}
+}
+
+func TestControlUnknownFields(t *testing.T) {
+	b := []byte{controlVersion}
+	b = appendField(b, 99, []byte("from the future"))
+	b = appendField(b, fieldSeqNo, []byte{5, 0xaa})
+	b = appendField(b, fieldReceived, []byte{3, 10, 0xbb, 0xcc})
+	var p ControlPacket
+	if err := p.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary(%x): %v", b, err)
+	}
+	want := ControlPacket{SeqNo: 5, Received: map[int]ReceivedEntry{3: {Bytes: 10}}}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("UnmarshalBinary(%x) = %+v, want %+v", b, p, want)
+	}
+}
+
+func TestControlTruncated(t *testing.T) {
+	b, err := controlPackets[2].MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(b); i++ {
+		var p ControlPacket
+		if err := p.UnmarshalBinary(b[:i]); err == nil {
+			// Cutting between fields leaves a valid packet with fewer links.
+			if p.SeqNo != controlPackets[2].SeqNo {
+				t.Errorf("UnmarshalBinary(%x) = %+v, want an error", b[:i], p)
+			}
+		}
+	}
+}
+
+func FuzzDecodeControl(f *testing.F) {
+	for _, p := range controlPackets {
+		b, err := p.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+		f.Add(gobControl(f, gobControlPacket{SeqNo: p.SeqNo, Received: p.Received}))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{controlVersion, fieldSeqNo, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var p ControlPacket
+		if err := p.UnmarshalBinary(b); err != nil {
+			return
+		}
+		// Whatever we accept has to survive another round.
+		enc, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary(%+v): %v", p, err)
+		}
+		var again ControlPacket
+		if err := again.UnmarshalBinary(enc); err != nil {
+			t.Fatalf("UnmarshalBinary(MarshalBinary(%+v)): %v", p, err)
+		}
+		if !reflect.DeepEqual(again, p) {
+			t.Fatalf("UnmarshalBinary(MarshalBinary(%+v)) = %+v", p, again)
+		}
+	})
+}
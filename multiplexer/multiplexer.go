@@ -1,13 +1,14 @@
 package multiplexer
 
 import (
-	"bytes"
-	"encoding/gob"
 	"log"
 	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"github.com/Jille/bindlink/multiplexer/sampler"
 	"github.com/Jille/bindlink/multiplexer/tallier"
+	"github.com/Jille/bindlink/packet"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -60,78 +61,133 @@ type ControlPacket struct {
 	Received map[int]ReceivedEntry
 }
 
+// Mux is safe for concurrent use. Send and Received don't lock: they use a
+// snapshot that changes publish under mtx.
 type Mux struct {
+	mtx            sync.Mutex
 	links          map[int]*LinkStats
-	sendToSystem   func([]byte) error
-	sendToLink     func(int, []byte) error
 	ourCtrlSeqNo   int
 	theirCtrlSeqNo int
-	sampler        *sampler.Sampler
+	weights        map[int]float64
+	// sched is the current *schedule.
+	sched atomic.Pointer[schedule]
+
+	sendToSystem func([]byte) error
+	sendToLink   func(int, *packet.Buffer) error
 }
 
 type LinkStats struct {
 	sent     *tallier.Tallier
 	received *tallier.Tallier
 	rate     float64
+	down     bool
+
+	// The metrics are looked up once, so counting a packet doesn't allocate.
+	packetsSent, bytesSent         prometheus.Counter
+	packetsReceived, bytesReceived prometheus.Counter
+}
+
+// schedule is an immutable snapshot of what Send and Received need.
+type schedule struct {
+	links map[int]*LinkStats
+	rates map[int]float64
+	// sampler picks from the links that are up, or is nil and we use fallback.
+	sampler  *sampler.Sampler
+	fallback []int
 }
 
 func New() *Mux {
-	return &Mux{
+	m := &Mux{
 		links: map[int]*LinkStats{},
 	}
+	m.publish()
+	return m
 }
 
-func (m *Mux) Start(toSystem func([]byte) error, toLink func(int, []byte) error) {
+// Start sets where packets go, before anything is sent or received. toLink must
+// retain buffers it keeps.
+func (m *Mux) Start(toSystem func([]byte) error, toLink func(int, *packet.Buffer) error) {
 	m.sendToSystem = toSystem
 	m.sendToLink = toLink
 }
 
-func (m *Mux) pickLinks() []int {
-	if m.sampler == nil {
-		for id, _ := range m.links {
-			return []int{id}
+// publish builds a new snapshot. m.mtx must be held.
+func (m *Mux) publish() {
+	sc := &schedule{
+		links: make(map[int]*LinkStats, len(m.links)),
+		rates: make(map[int]float64, len(m.links)),
+	}
+	weights := map[int]float64{}
+	for id, link := range m.links {
+		sc.links[id] = link
+		sc.rates[id] = link.rate
+		if link.down {
+			continue
+		}
+		sc.fallback = append(sc.fallback, id)
+		if w, ok := m.weights[id]; ok {
+			weights[id] = w
+		}
+	}
+	if m.weights != nil && len(weights) > 0 {
+		sc.sampler = sampler.New(weights)
+	}
+	m.sched.Store(sc)
+}
+
+// pickLinks appends the links to send a packet over to ret.
+func (sc *schedule) pickLinks(ret []int) []int {
+	if sc.sampler == nil {
+		if len(sc.fallback) == 0 {
+			return ret
 		}
-		return []int{}
+		return append(ret, sc.fallback[0])
 	}
 
 	prob := float64(0)
-	lut := map[int]bool{}
 
 	// TODO add sampler.SampleDistinct to do this properly and efficiently
 	for i := 0; i < 10; i++ {
-		id := m.sampler.Sample()
-		if _, ok := lut[id]; ok {
+		id := sc.sampler.Sample()
+		if containsInt(ret, id) {
 			continue
 		}
-		lut[id] = true
-		prob += m.links[id].rate
+		ret = append(ret, id)
+		prob += sc.rates[id]
 		// if prob > 0.9 {
 		// 	break
 		// }
 		break // TODO
 	}
 
-	ret := []int{}
-	for id, _ := range lut {
-		ret = append(ret, id)
-	}
-
 	metrDuplication.Observe(float64(len(ret)))
 
 	return ret
 }
 
-func (m *Mux) Send(packet []byte) error {
-	ids := m.pickLinks()
+func containsInt(s []int, v int) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Mux) Send(p *packet.Buffer) error {
+	sc := m.sched.Load()
+	var picked [4]int
+	ids := sc.pickLinks(picked[:0])
 	ok := false
 	var err error
 	for _, id := range ids {
-		err = m.sendToLink(id, packet)
+		err = m.sendToLink(id, p)
 		if err == nil {
 			ok = true
-			m.links[id].sent.TallyN(uint64(len(packet)))
-			metrPacketsSent.With(prometheus.Labels{"link": strconv.Itoa(id)}).Inc()
-			metrBytesSent.With(prometheus.Labels{"link": strconv.Itoa(id)}).Add(float64(len(packet)))
+			link := sc.links[id]
+			link.sent.TallyN(uint64(p.Len()))
+			link.packetsSent.Inc()
+			link.bytesSent.Add(float64(p.Len()))
 		}
 	}
 	if ok {
@@ -141,28 +197,55 @@ func (m *Mux) Send(packet []byte) error {
 }
 
 func (m *Mux) Received(linkId int, packet []byte) error {
-	m.links[linkId].received.TallyN(uint64(len(packet)))
-	metrPacketsReceived.With(prometheus.Labels{
-		"link": strconv.Itoa(linkId),
-	}).Inc()
-	metrBytesReceived.With(prometheus.Labels{
-		"link": strconv.Itoa(linkId),
-	}).Add(float64(len(packet)))
+	link := m.sched.Load().links[linkId]
+	if link == nil {
+		// The link was removed while this packet was on its way.
+		return nil
+	}
+	link.received.TallyN(uint64(len(packet)))
+	link.packetsReceived.Inc()
+	link.bytesReceived.Add(float64(len(packet)))
 	return m.sendToSystem(packet)
 }
 
 func (m *Mux) AddLink(linkId int) {
-	m.links[linkId] = NewLinkStats()
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.links[linkId] = NewLinkStats(linkId)
+	m.publish()
+}
+
+// RemoveLink stops sending packets over linkId.
+func (m *Mux) RemoveLink(linkId int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.links, linkId)
+	delete(m.weights, linkId)
+	m.publish()
+	metrLinkRate.Delete(prometheus.Labels{"link": strconv.Itoa(linkId)})
+}
+
+// SetLinkUp marks whether linkId can carry packets right now.
+func (m *Mux) SetLinkUp(linkId int, up bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	link, ok := m.links[linkId]
+	if !ok || link.down == !up {
+		return
+	}
+	link.down = !up
+	m.publish()
 }
 
 func (m *Mux) HandleControl(linkId int, buf []byte) {
-	dec := gob.NewDecoder(bytes.NewBuffer(buf))
 	var packet ControlPacket
-	if err := dec.Decode(&packet); err != nil {
-		log.Printf("CraftControl: gob.Decode(): %v", err)
+	if err := packet.UnmarshalBinary(buf); err != nil {
+		log.Printf("HandleControl: dropping control packet from link %d: %v", linkId, err)
 		return
 	}
 
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
 	if packet.SeqNo == m.theirCtrlSeqNo {
 		return // Already seen this control packet
 	}
@@ -192,10 +275,13 @@ func (m *Mux) HandleControl(linkId int, buf []byte) {
 		}
 		metrLinkRate.With(prometheus.Labels{"link": strconv.Itoa(id)}).Set(link.rate)
 	}
-	m.sampler = sampler.New(weights)
+	m.weights = weights
+	m.publish()
 }
 
 func (m *Mux) CraftControl() []byte {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
 	m.ourCtrlSeqNo++
 	packet := ControlPacket{
 		SeqNo:    m.ourCtrlSeqNo,
@@ -208,18 +294,18 @@ func (m *Mux) CraftControl() []byte {
 		}
 	}
 
-	// encode
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(packet); err != nil {
-		log.Fatalf("CraftControl: gob.Encode(): %v", err)
-	}
-	return buf.Bytes()
+	buf, _ := packet.MarshalBinary()
+	return buf
 }
 
-func NewLinkStats() *LinkStats {
+func NewLinkStats(linkId int) *LinkStats {
+	labels := prometheus.Labels{"link": strconv.Itoa(linkId)}
 	return &LinkStats{
-		sent:     tallier.New(100, 5000), // 5s window with 100ms bucket size
-		received: tallier.New(100, 5000),
+		sent:            tallier.New(100, 5000), // 5s window with 100ms bucket size
+		received:        tallier.New(100, 5000),
+		packetsSent:     metrPacketsSent.With(labels),
+		bytesSent:       metrBytesSent.With(labels),
+		packetsReceived: metrPacketsReceived.With(labels),
+		bytesReceived:   metrBytesReceived.With(labels),
 	}
 }
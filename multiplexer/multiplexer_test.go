@@ -0,0 +1,102 @@
+package multiplexer
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Jille/bindlink/packet"
+)
+
+const testLinks = 4
+
+// TestConcurrent uses a Mux from many goroutines at once. Run it with -race.
+func TestConcurrent(t *testing.T) {
+	m := New()
+	var sent, received atomic.Int64
+	var bad atomic.Value
+	m.Start(func([]byte) error {
+		received.Add(1)
+		return nil
+	}, func(id int, p *packet.Buffer) error {
+		if id < 1 || id > testLinks {
+			bad.Store(fmt.Sprintf("sent over link %d, which never existed", id))
+		}
+		sent.Add(1)
+		return nil
+	})
+	for id := 1; id <= testLinks; id++ {
+		m.AddLink(id)
+	}
+
+	const rounds = 2000
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				f(i)
+			}
+		}()
+	}
+	for g := 0; g < 2; g++ {
+		run(func(int) {
+			p := packet.Get(100)
+			m.Send(p)
+			p.Release()
+		})
+		run(func(i int) {
+			m.Received(1+i%testLinks, make([]byte, 100))
+		})
+	}
+	// Link 1 always stays, the others come and go.
+	run(func(i int) {
+		id := 2 + i%(testLinks-1)
+		if i%2 == 0 {
+			m.RemoveLink(id)
+		} else {
+			m.AddLink(id)
+		}
+	})
+	run(func(i int) {
+		m.SetLinkUp(1+i%testLinks, i%3 != 0)
+	})
+	// Both sides of the control exchange, as if the peer echoed our packets.
+	run(func(int) {
+		m.HandleControl(1, m.CraftControl())
+	})
+	wg.Wait()
+
+	if msg := bad.Load(); msg != nil {
+		t.Error(msg)
+	}
+	if sent.Load() == 0 {
+		t.Error("nothing was sent")
+	}
+	// Packets for removed links are dropped, but link 1 was always there.
+	if got, min, max := received.Load(), int64(2*rounds/testLinks), int64(2*rounds); got < min || got > max {
+		t.Errorf("received %d packets, want between %d and %d", got, min, max)
+	}
+
+	// Now that everything settled, only links that are up are used.
+	m.SetLinkUp(1, true)
+	for id := 2; id <= testLinks; id++ {
+		m.RemoveLink(id)
+	}
+	m.HandleControl(1, m.CraftControl())
+	m.Start(func([]byte) error { return nil }, func(id int, p *packet.Buffer) error {
+		if id != 1 {
+			t.Errorf("sent over link %d, want only link 1", id)
+		}
+		return nil
+	})
+	for i := 0; i < 100; i++ {
+		p := packet.Get(100)
+		if err := m.Send(p); err != nil {
+			t.Errorf("Send: %v", err)
+		}
+		p.Release()
+	}
+}
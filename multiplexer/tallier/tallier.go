@@ -1,6 +1,7 @@
 package tallier
 
 import (
+	"sync"
 	"time"
 )
 
@@ -10,6 +11,7 @@ type tallierBucket struct {
 }
 
 type Tallier struct {
+	mtx        sync.Mutex
 	bucketSize int64
 	window     int64
 	nBuckets   int64
@@ -36,6 +38,8 @@ func (t *Tallier) Tally() {
 
 func (t *Tallier) TallyN(n uint64) {
 	start := nowMillis() / t.bucketSize
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
 	bucket := start % t.nBuckets
 	if t.buckets[bucket].start != start {
 		t.buckets[bucket].start = start
@@ -48,6 +52,8 @@ func (t *Tallier) TallyN(n uint64) {
 func (t *Tallier) Count() uint64 {
 	ret := uint64(0)
 	start := (nowMillis() - t.window) / t.bucketSize
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
 	for i := 0; i < int(t.nBuckets); i++ {
 		if t.buckets[i].start < start {
 			continue
@@ -0,0 +1,116 @@
+// Package packet provides pooled packet buffers with room for headers.
+package packet
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// Headroom fits our header and a SOCKS header with an IPv6 address.
+	Headroom = 64
+	// PooledSize is the payload size of pooled buffers.
+	PooledSize = 2048
+)
+
+// Buffer holds a packet. It's reference counted: Retain to keep it after
+// passing it on, Release when done.
+type Buffer struct {
+	data       []byte
+	start, end int
+	refs       atomic.Int32
+}
+
+var pool = sync.Pool{
+	New: func() any {
+		return &Buffer{data: make([]byte, Headroom+PooledSize)}
+	},
+}
+
+// Get returns a buffer of size bytes, which aren't zeroed.
+func Get(size int) *Buffer {
+	var b *Buffer
+	if size <= PooledSize {
+		b = pool.Get().(*Buffer)
+	} else {
+		b = &Buffer{data: make([]byte, Headroom+size)}
+	}
+	b.start = Headroom
+	b.end = Headroom + size
+	b.refs.Store(1)
+	return b
+}
+
+// FromBytes returns a buffer holding a copy of p.
+func FromBytes(p []byte) *Buffer {
+	b := Get(len(p))
+	copy(b.Bytes(), p)
+	return b
+}
+
+// Bytes returns the packet. It's valid until the buffer is released.
+func (b *Buffer) Bytes() []byte {
+	return b.data[b.start:b.end]
+}
+
+func (b *Buffer) Len() int {
+	return b.end - b.start
+}
+
+// Headroom returns how many bytes can still be prepended.
+func (b *Buffer) Headroom() int {
+	return b.start
+}
+
+// Truncate shortens the packet to n bytes.
+func (b *Buffer) Truncate(n int) {
+	if n < 0 || n > b.Len() {
+		panic("packet: Truncate out of range")
+	}
+	b.end = b.start + n
+}
+
+// Prepend grows the packet by n bytes at the front and returns them.
+func (b *Buffer) Prepend(n int) []byte {
+	if n > b.start {
+		panic("packet: not enough headroom")
+	}
+	b.start -= n
+	return b.data[b.start : b.start+n]
+}
+
+// Consume removes n bytes from the front of the packet.
+func (b *Buffer) Consume(n int) {
+	if n > b.Len() {
+		panic("packet: Consume beyond the end")
+	}
+	b.start += n
+}
+
+// Retain takes another reference.
+func (b *Buffer) Retain() {
+	b.refs.Add(1)
+}
+
+// Shared returns whether someone else holds a reference, so it mustn't change.
+func (b *Buffer) Shared() bool {
+	return b.refs.Load() > 1
+}
+
+// Clone returns an unshared copy of the packet.
+func (b *Buffer) Clone() *Buffer {
+	return FromBytes(b.Bytes())
+}
+
+// Release drops a reference. The buffer mustn't be used anymore afterwards.
+func (b *Buffer) Release() {
+	switch n := b.refs.Add(-1); {
+	case n > 0:
+		return
+	case n < 0:
+		panic("packet: Release of a released buffer")
+	}
+	if len(b.data) == Headroom+PooledSize {
+		pool.Put(b)
+	}
+}
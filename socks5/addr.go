@@ -0,0 +1,138 @@
+// Package socks5 implements the parts of SOCKS5 (RFC 1928) that bindlink needs.
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Address types (ATYP).
+const (
+	AddrIPv4   = 1
+	AddrDomain = 3
+	AddrIPv6   = 4
+)
+
+// Addr is an IP or domain name and a port, as used in requests, replies and UDP
+// headers.
+type Addr struct {
+	IP   net.IP
+	Host string // only used if IP is nil
+	Port int
+}
+
+func AddrFromUDP(addr *net.UDPAddr) Addr {
+	return Addr{IP: addr.IP, Port: addr.Port}
+}
+
+func (a Addr) String() string {
+	if a.IP == nil {
+		return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+	}
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+}
+
+// Size returns the number of bytes Put will write.
+func (a Addr) Size() int {
+	switch {
+	case a.IP == nil:
+		return 1 + 1 + len(a.Host) + 2
+	case a.IP.To4() != nil:
+		return 1 + 4 + 2
+	default:
+		return 1 + 16 + 2
+	}
+}
+
+// Put encodes a into buf, which must fit a.Size() bytes, and returns that size.
+func (a Addr) Put(buf []byte) int {
+	var n int
+	if a.IP == nil {
+		buf[0] = AddrDomain
+		buf[1] = byte(len(a.Host))
+		n = 2 + copy(buf[2:], a.Host)
+	} else if ip := a.IP.To4(); ip != nil {
+		buf[0] = AddrIPv4
+		n = 1 + copy(buf[1:], ip)
+	} else {
+		buf[0] = AddrIPv6
+		n = 1 + copy(buf[1:], a.IP.To16())
+	}
+	binary.BigEndian.PutUint16(buf[n:], uint16(a.Port))
+	return n + 2
+}
+
+// Validate checks whether a can be encoded.
+func (a Addr) Validate() error {
+	if a.IP == nil && (len(a.Host) == 0 || len(a.Host) > 255) {
+		return fmt.Errorf("SOCKS domain name should be 1-255 bytes, got %q", a.Host)
+	}
+	if a.IP != nil && a.IP.To16() == nil {
+		return fmt.Errorf("invalid IP address %v", a.IP)
+	}
+	return nil
+}
+
+var errShortAddr = errors.New("truncated SOCKS address")
+
+// DecodeAddr decodes the address at the start of b and returns its size.
+func DecodeAddr(b []byte) (Addr, int, error) {
+	if len(b) < 1 {
+		return Addr{}, 0, errShortAddr
+	}
+	var a Addr
+	var n int
+	switch b[0] {
+	case AddrIPv4:
+		if len(b) < 1+4+2 {
+			return Addr{}, 0, errShortAddr
+		}
+		a.IP = net.IPv4(b[1], b[2], b[3], b[4])
+		n = 5
+	case AddrIPv6:
+		if len(b) < 1+16+2 {
+			return Addr{}, 0, errShortAddr
+		}
+		a.IP = make(net.IP, 16)
+		copy(a.IP, b[1:17])
+		n = 17
+	case AddrDomain:
+		if len(b) < 2 || len(b) < 2+int(b[1])+2 {
+			return Addr{}, 0, errShortAddr
+		}
+		a.Host = string(b[2 : 2+int(b[1])])
+		n = 2 + int(b[1])
+	default:
+		return Addr{}, 0, fmt.Errorf("address type should be 1, 3 or 4, was %d", b[0])
+	}
+	a.Port = int(binary.BigEndian.Uint16(b[n:]))
+	return a, n + 2, nil
+}
+
+// ReadAddr reads an address from a SOCKS control connection.
+func ReadAddr(r io.Reader) (Addr, error) {
+	var buf [1 + 1 + 255 + 2]byte
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return Addr{}, err
+	}
+	var l int
+	switch buf[0] {
+	case AddrIPv4:
+		l = 1 + 4 + 2
+	case AddrIPv6:
+		l = 1 + 16 + 2
+	case AddrDomain:
+		l = 2 + int(buf[1]) + 2
+	default:
+		return Addr{}, fmt.Errorf("address type should be 1, 3 or 4, was %d", buf[0])
+	}
+	if _, err := io.ReadFull(r, buf[2:l]); err != nil {
+		return Addr{}, err
+	}
+	a, _, err := DecodeAddr(buf[:l])
+	return a, err
+}
@@ -0,0 +1,73 @@
+package socks5
+
+import (
+	"time"
+)
+
+// FragEnd is set in the FRAG field of the last fragment of a datagram.
+const FragEnd = 0x80
+
+// Reassembler puts fragmented datagrams back together (RFC 1928 section 7). It
+// is not safe for concurrent use.
+type Reassembler struct {
+	// Timeout abandons incomplete datagrams. The RFC requires at least 5s.
+	Timeout time.Duration
+	// MaxSize is the largest datagram we are willing to reassemble.
+	MaxSize int
+
+	buf     []byte
+	last    byte
+	started time.Time
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		Timeout: 5 * time.Second,
+		MaxSize: 65535,
+	}
+}
+
+func (r *Reassembler) reset() {
+	r.buf = r.buf[:0]
+	r.last = 0
+}
+
+// Add returns the complete datagram once all fragments are in. It's only valid
+// until the next call.
+func (r *Reassembler) Add(frag byte, payload []byte) ([]byte, bool) {
+	if frag == 0 {
+		// A standalone datagram abandons any reassembly in progress.
+		r.reset()
+		return payload, true
+	}
+	pos := frag &^ FragEnd
+	if pos == 0 {
+		return nil, false
+	}
+	if r.last != 0 && time.Since(r.started) > r.Timeout {
+		r.reset()
+	}
+	if pos != r.last+1 {
+		// A new datagram started or we lost a fragment.
+		r.reset()
+		if pos != 1 {
+			return nil, false
+		}
+	}
+	if pos == 1 {
+		r.started = time.Now()
+	}
+	if len(r.buf)+len(payload) > r.MaxSize {
+		r.reset()
+		return nil, false
+	}
+	r.buf = append(r.buf, payload...)
+	r.last = pos
+	if frag&FragEnd == 0 {
+		return nil, false
+	}
+	ret := r.buf
+	r.buf = nil
+	r.last = 0
+	return ret, true
+}
@@ -0,0 +1,43 @@
+package socks5
+
+import (
+	"fmt"
+)
+
+// Reply codes (REP).
+const (
+	ReplySucceeded               = 0
+	ReplyGeneralFailure          = 1
+	ReplyNotAllowed              = 2
+	ReplyNetworkUnreachable      = 3
+	ReplyHostUnreachable         = 4
+	ReplyConnectionRefused       = 5
+	ReplyTTLExpired              = 6
+	ReplyCommandNotSupported     = 7
+	ReplyAddressTypeNotSupported = 8
+)
+
+func ReplyText(code byte) string {
+	switch code {
+	case ReplySucceeded:
+		return "succeeded"
+	case ReplyGeneralFailure:
+		return "general SOCKS server failure"
+	case ReplyNotAllowed:
+		return "connection not allowed by ruleset"
+	case ReplyNetworkUnreachable:
+		return "network unreachable"
+	case ReplyHostUnreachable:
+		return "host unreachable"
+	case ReplyConnectionRefused:
+		return "connection refused"
+	case ReplyTTLExpired:
+		return "TTL expired"
+	case ReplyCommandNotSupported:
+		return "command not supported"
+	case ReplyAddressTypeNotSupported:
+		return "address type not supported"
+	default:
+		return fmt.Sprintf("unknown status %d", code)
+	}
+}
@@ -0,0 +1,272 @@
+package socks5
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Server is a SOCKS5 server that only supports UDP ASSOCIATE.
+type Server struct {
+	// Username and Password enable RFC 1929 authentication if Username is set.
+	Username string
+	Password string
+	// IdleTimeout closes idle UDP associations. Zero means never.
+	IdleTimeout time.Duration
+}
+
+// Serve accepts connections on l until it fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.handle(conn); err != nil {
+				log.Printf("SOCKS connection from %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := s.negotiateAuth(conn); err != nil {
+		return err
+	}
+
+	var req [3]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return err
+	}
+	if req[0] != 5 {
+		return fmt.Errorf("unexpected version in request: %d", req[0])
+	}
+	clientAddr, err := ReadAddr(conn)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return err
+		}
+		reply(conn, ReplyAddressTypeNotSupported, Addr{IP: net.IPv4zero})
+		return err
+	}
+	if req[1] != 3 {
+		reply(conn, ReplyCommandNotSupported, Addr{IP: net.IPv4zero})
+		return fmt.Errorf("unsupported command %d", req[1])
+	}
+
+	// Bind the relay where the client reached us, so the address works for
+	// them.
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		reply(conn, ReplyGeneralFailure, Addr{IP: net.IPv4zero})
+		return err
+	}
+	defer relay.Close()
+	if err := reply(conn, ReplySucceeded, AddrFromUDP(relay.LocalAddr().(*net.UDPAddr))); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	a := &association{
+		server: s,
+		relay:  relay,
+		// Only accept the client's IP. Unless it told us, the port is learned
+		// from the first datagram.
+		clientIP:   conn.RemoteAddr().(*net.TCPAddr).IP,
+		clientPort: clientAddr.Port,
+		resolved:   map[string]*net.UDPAddr{},
+		sentTo:     map[netip.AddrPort]bool{},
+		reasm:      NewReassembler(),
+	}
+	go func() {
+		// The association lives as long as the control connection.
+		io.Copy(io.Discard, conn)
+		relay.Close()
+	}()
+	return a.run()
+}
+
+func (s *Server) negotiateAuth(conn net.Conn) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != 5 {
+		return fmt.Errorf("unexpected version in greeting: %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	want := byte(0)
+	if s.Username != "" {
+		want = 2
+	}
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+		}
+	}
+	if !offered {
+		conn.Write([]byte{5, 0xff})
+		return fmt.Errorf("client didn't offer authentication method %d", want)
+	}
+	if _, err := conn.Write([]byte{5, want}); err != nil {
+		return err
+	}
+	if want == 0 {
+		return nil
+	}
+
+	var ver [2]byte
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		return err
+	}
+	user := make([]byte, ver[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(conn, plen[:]); err != nil {
+		return err
+	}
+	pass := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return err
+	}
+	ok := subtle.ConstantTimeCompare(user, []byte(s.Username)) == 1
+	ok = subtle.ConstantTimeCompare(pass, []byte(s.Password)) == 1 && ok
+	if ver[0] != 1 || !ok {
+		conn.Write([]byte{1, 1})
+		return fmt.Errorf("authentication failed for user %q", user)
+	}
+	_, err := conn.Write([]byte{1, 0})
+	return err
+}
+
+func reply(conn net.Conn, code byte, bound Addr) error {
+	buf := make([]byte, 3+bound.Size())
+	buf[0] = 5
+	buf[1] = code
+	bound.Put(buf[3:])
+	_, err := conn.Write(buf)
+	return err
+}
+
+// maxDestinations bounds the domain names an association caches and the
+// addresses it remembers the client sent to. They're forgotten when full.
+const maxDestinations = 256
+
+type association struct {
+	server     *Server
+	relay      *net.UDPConn
+	clientIP   net.IP
+	clientPort int
+	resolved   map[string]*net.UDPAddr
+	// sentTo holds the addresses the client sent to. Only they can send
+	// datagrams back, so the relay can't be used to reach the client
+	// unasked.
+	sentTo map[netip.AddrPort]bool
+	reasm  *Reassembler
+}
+
+func (a *association) run() error {
+	buf := make([]byte, 65536)
+	for {
+		if a.server.IdleTimeout > 0 {
+			a.relay.SetReadDeadline(time.Now().Add(a.server.IdleTimeout))
+		}
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			// Idle for too long, or the control connection closed the relay.
+			return nil
+		}
+		if a.isClient(from) {
+			a.fromClient(buf[:n])
+		} else if a.clientPort != 0 && a.sentTo[addrPort(from)] {
+			a.toClient(buf, n, from)
+		}
+	}
+}
+
+func (a *association) isClient(from *net.UDPAddr) bool {
+	if !from.IP.Equal(a.clientIP) {
+		return false
+	}
+	if a.clientPort == 0 {
+		a.clientPort = from.Port
+	}
+	return from.Port == a.clientPort
+}
+
+func (a *association) fromClient(b []byte) {
+	if len(b) < 3 || b[0] != 0 || b[1] != 0 {
+		return
+	}
+	dst, n, err := DecodeAddr(b[3:])
+	if err != nil {
+		return
+	}
+	payload, complete := a.reasm.Add(b[2], b[3+n:])
+	if !complete {
+		return
+	}
+	addr, err := a.resolve(dst)
+	if err != nil {
+		log.Printf("Failed to resolve %s: %v", dst, err)
+		return
+	}
+	if key := addrPort(addr); !a.sentTo[key] {
+		if len(a.sentTo) >= maxDestinations {
+			clear(a.sentTo)
+		}
+		a.sentTo[key] = true
+	}
+	a.relay.WriteToUDP(payload, addr)
+}
+
+func addrPort(addr *net.UDPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+func (a *association) resolve(dst Addr) (*net.UDPAddr, error) {
+	if dst.IP != nil {
+		return &net.UDPAddr{IP: dst.IP, Port: dst.Port}, nil
+	}
+	key := dst.String()
+	if addr, ok := a.resolved[key]; ok {
+		return addr, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", key)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.resolved) >= maxDestinations {
+		clear(a.resolved)
+	}
+	a.resolved[key] = addr
+	return addr, nil
+}
+
+// toClient wraps the n byte datagram in buf, which needs room for the header.
+func (a *association) toClient(buf []byte, n int, from *net.UDPAddr) {
+	src := AddrFromUDP(from)
+	hdrLen := 3 + src.Size()
+	if n+hdrLen > len(buf) {
+		return
+	}
+	copy(buf[hdrLen:], buf[:n])
+	buf[0], buf[1], buf[2] = 0, 0, 0
+	src.Put(buf[3:])
+	a.relay.WriteToUDP(buf[:hdrLen+n], &net.UDPAddr{IP: a.clientIP, Port: a.clientPort})
+}
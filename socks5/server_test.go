@@ -0,0 +1,198 @@
+package socks5_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jille/bindlink/socks5"
+)
+
+// udpEcho returns the address of a socket on ip that sends every datagram back.
+func udpEcho(t *testing.T, ip net.IP) *net.UDPAddr {
+	sock := listenUDP(t, ip)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := sock.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			sock.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return sock.LocalAddr().(*net.UDPAddr)
+}
+
+func listenUDP(t *testing.T, ip net.IP) *net.UDPConn {
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sock.Close() })
+	return sock
+}
+
+// serve runs s on loopback and returns its address.
+func serve(t *testing.T, s *socks5.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+// request sends cmd for client to the server without authentication, and
+// returns the control connection, the reply code and the bound address.
+func request(t *testing.T, server string, cmd byte, client socks5.Addr) (net.Conn, byte, socks5.Addr) {
+	t.Helper()
+	conn, err := net.Dial("tcp", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := make([]byte, 3+3+client.Size())
+	copy(req, []byte{5, 1, 0, 5, cmd, 0})
+	client.Put(req[6:])
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	var resp [2 + 3]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		t.Fatal(err)
+	}
+	if resp[0] != 5 || resp[1] != 0 {
+		t.Fatalf("server picked authentication method %d, want 0", resp[1])
+	}
+	bound, err := socks5.ReadAddr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, resp[3], bound
+}
+
+// associate sets up a UDP association for client and returns its relay.
+func associate(t *testing.T, server string, client socks5.Addr) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+	conn, code, bound := request(t, server, 3, client)
+	if code != socks5.ReplySucceeded {
+		t.Fatalf("UDP ASSOCIATE failed: %s", socks5.ReplyText(code))
+	}
+	return conn, &net.UDPAddr{IP: bound.IP, Port: bound.Port}
+}
+
+// send sends payload for dst from sock through relay.
+func send(t *testing.T, sock *net.UDPConn, relay *net.UDPAddr, dst socks5.Addr, payload string) {
+	t.Helper()
+	buf := make([]byte, 3+dst.Size()+len(payload))
+	n := 3 + dst.Put(buf[3:])
+	copy(buf[n:], payload)
+	if _, err := sock.WriteToUDP(buf, relay); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive returns the next datagram the relay sent to sock and its source.
+func receive(t *testing.T, sock *net.UDPConn) (string, socks5.Addr) {
+	t.Helper()
+	buf := make([]byte, 65536)
+	sock.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := sock.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 3 || !bytes.Equal(buf[:3], []byte{0, 0, 0}) {
+		t.Fatalf("datagram from the relay has header %x", buf[:min(n, 3)])
+	}
+	src, an, err := socks5.DecodeAddr(buf[3:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[3+an : n]), src
+}
+
+func TestUnsupportedCommand(t *testing.T) {
+	server := serve(t, &socks5.Server{})
+	const connect = 1
+	conn, code, _ := request(t, server, connect, socks5.Addr{IP: net.IPv4(192, 0, 2, 1), Port: 80})
+	if code != socks5.ReplyCommandNotSupported {
+		t.Errorf("CONNECT got reply %q, want %q", socks5.ReplyText(code), socks5.ReplyText(socks5.ReplyCommandNotSupported))
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("server didn't close the connection after refusing CONNECT: %v", err)
+	}
+}
+
+func TestDomainDestination(t *testing.T) {
+	localhost, err := net.ResolveUDPAddr("udp", "localhost:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	echo := udpEcho(t, localhost.IP)
+	client := listenUDP(t, net.IPv4(127, 0, 0, 1))
+	server := serve(t, &socks5.Server{})
+	_, relay := associate(t, server, socks5.AddrFromUDP(client.LocalAddr().(*net.UDPAddr)))
+
+	send(t, client, relay, socks5.Addr{Host: "localhost", Port: echo.Port}, "hello")
+	got, src := receive(t, client)
+	if got != "hello" {
+		t.Errorf("got %q back, want %q", got, "hello")
+	}
+	if !src.IP.Equal(echo.IP) || src.Port != echo.Port {
+		t.Errorf("reply came from %s, want %s", src, echo)
+	}
+}
+
+func TestClientPortPinned(t *testing.T) {
+	echo := udpEcho(t, net.IPv4(127, 0, 0, 1))
+	client := listenUDP(t, net.IPv4(127, 0, 0, 1))
+	other := listenUDP(t, net.IPv4(127, 0, 0, 1))
+	server := serve(t, &socks5.Server{})
+	// Without a port the server pins the first one it hears from.
+	_, relay := associate(t, server, socks5.Addr{IP: net.IPv4zero})
+
+	send(t, client, relay, socks5.AddrFromUDP(echo), "first")
+	if got, _ := receive(t, client); got != "first" {
+		t.Fatalf("got %q back, want %q", got, "first")
+	}
+	send(t, other, relay, socks5.AddrFromUDP(echo), "other port")
+	send(t, client, relay, socks5.AddrFromUDP(echo), "second")
+	if got, _ := receive(t, client); got != "second" {
+		t.Errorf("got %q back, want %q", got, "second")
+	}
+}
+
+func TestRepliesOnlyFromDestinations(t *testing.T) {
+	echo := udpEcho(t, net.IPv4(127, 0, 0, 1))
+	stranger := listenUDP(t, net.IPv4(127, 0, 0, 1))
+	client := listenUDP(t, net.IPv4(127, 0, 0, 1))
+	server := serve(t, &socks5.Server{})
+	_, relay := associate(t, server, socks5.AddrFromUDP(client.LocalAddr().(*net.UDPAddr)))
+
+	if _, err := stranger.WriteToUDP([]byte("unasked"), relay); err != nil {
+		t.Fatal(err)
+	}
+	send(t, client, relay, socks5.AddrFromUDP(echo), "hello")
+	got, src := receive(t, client)
+	if got != "hello" || !src.IP.Equal(echo.IP) || src.Port != echo.Port {
+		t.Errorf("got %q from %s, want %q from %s", got, src, "hello", echo)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	client := listenUDP(t, net.IPv4(127, 0, 0, 1))
+	server := serve(t, &socks5.Server{IdleTimeout: 50 * time.Millisecond})
+	conn, _ := associate(t, server, socks5.AddrFromUDP(client.LocalAddr().(*net.UDPAddr)))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle association wasn't closed: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"github.com/Jille/bindlink/socks5"
+)
+
+// socksServerMain implements `bindlink socks-server`, to run on link devices.
+func socksServerMain(args []string) {
+	fs := flag.NewFlagSet("socks-server", flag.ExitOnError)
+	listen := fs.String("listen", ":1080", "Address to accept SOCKS connections on")
+	username := fs.String("username", "", "Require clients to authenticate with this username")
+	password := fs.String("password", "", "Password for --username; defaults to $BINDLINK_SOCKS_PASSWORD")
+	allowUnauthenticated := fs.Bool("allow_unauthenticated", false, "Run without --username. Anyone who can reach --listen can then relay UDP through this host")
+	idleTimeout := fs.Duration("idle_timeout", 0, "Close UDP associations that have been idle this long (0 to keep them while the control connection lives)")
+	fs.Parse(args)
+
+	if *password == "" {
+		*password = os.Getenv("BINDLINK_SOCKS_PASSWORD")
+	}
+	if *username == "" && *password != "" {
+		log.Fatalf("--password given without --username")
+	}
+	if *username == "" && !*allowUnauthenticated {
+		log.Fatalf("--username is required, unless you pass --allow_unauthenticated to run an open relay")
+	}
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", *listen, err)
+	}
+	log.Printf("SOCKS5 server listening on %s", l.Addr())
+	s := &socks5.Server{
+		Username:    *username,
+		Password:    *password,
+		IdleTimeout: *idleTimeout,
+	}
+	log.Fatal(s.Serve(l))
+}
@@ -0,0 +1,79 @@
+//go:build notun
+// +build notun
+
+package tundev
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/Jille/bindlink/packet"
+)
+
+// In notun mode every packet is a frame: a type byte, a 32 bit sequence number,
+// a 16 bit payload length and the payload.
+// Ack frames carry the sequence number of the next frame the receiver expects.
+const (
+	frameData = 'D'
+	frameFin  = 'F'
+	frameAck  = 'A'
+
+	frameHeaderLen  = 7
+	maxFramePayload = 1400
+
+	sendWindow = 1024
+	// A frame is retransmitted if it isn't acked within retransmitTimeout,
+	// which doubles for every retransmission up to maxRetransmitTimeout.
+	retransmitTimeout    = 500 * time.Millisecond
+	maxRetransmitTimeout = 8 * time.Second
+
+	// We ack after ackEvery frames or ackDelay, whichever comes first.
+	ackEvery = 32
+	ackDelay = 20 * time.Millisecond
+)
+
+type frame struct {
+	typ     byte
+	seq     uint32
+	payload []byte
+	// buf is the encoded frame, for frames we send.
+	buf    *packet.Buffer
+	sentAt time.Time
+	// rto is how long after sentAt the frame is retransmitted.
+	rto time.Duration
+}
+
+// newFrame turns p into a frame, adding the header in its headroom.
+func newFrame(typ byte, seq uint32, p *packet.Buffer) *frame {
+	data := p.Bytes()
+	data[0] = typ
+	binary.BigEndian.PutUint32(data[1:], seq)
+	binary.BigEndian.PutUint16(data[5:], uint16(len(data)-frameHeaderLen))
+	return &frame{
+		typ:     typ,
+		seq:     seq,
+		payload: data[frameHeaderLen:],
+		buf:     p,
+	}
+}
+
+func decodeFrame(b []byte) (*frame, error) {
+	if len(b) < frameHeaderLen {
+		return nil, fmt.Errorf("short frame of %d bytes", len(b))
+	}
+	switch b[0] {
+	case frameData, frameFin, frameAck:
+	default:
+		return nil, fmt.Errorf("unknown frame type %d", b[0])
+	}
+	l := int(binary.BigEndian.Uint16(b[5:]))
+	if l != len(b)-frameHeaderLen {
+		return nil, fmt.Errorf("frame length %d doesn't match packet of %d bytes", l, len(b)-frameHeaderLen)
+	}
+	return &frame{
+		typ:     b[0],
+		seq:     binary.BigEndian.Uint32(b[1:]),
+		payload: b[frameHeaderLen:],
+	}, nil
+}
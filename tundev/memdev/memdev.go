@@ -0,0 +1,57 @@
+// Package memdev is an in-memory tundev.Device for tests.
+package memdev
+
+import (
+	"errors"
+
+	"github.com/Jille/bindlink/packet"
+)
+
+var ErrFull = errors.New("memdev: receive queue full")
+
+type Device struct {
+	toMux    chan *packet.Buffer
+	received chan []byte
+}
+
+func New(queueSize int) *Device {
+	return &Device{
+		toMux:    make(chan *packet.Buffer, queueSize),
+		received: make(chan []byte, queueSize),
+	}
+}
+
+// Run passes injected packets to sendToMultiplexer until Close.
+func (d *Device) Run(sendToMultiplexer func(*packet.Buffer) error) {
+	for p := range d.toMux {
+		err := sendToMultiplexer(p)
+		p.Release()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Send is called by the multiplexer for packets that came out of the tunnel.
+func (d *Device) Send(packet []byte) error {
+	select {
+	case d.received <- append([]byte(nil), packet...):
+		return nil
+	default:
+		return ErrFull
+	}
+}
+
+// Inject pretends the system sent p into the tunnel.
+func (d *Device) Inject(p []byte) {
+	d.toMux <- packet.FromBytes(p)
+}
+
+// Received returns the packets that came out of the tunnel.
+func (d *Device) Received() <-chan []byte {
+	return d.received
+}
+
+func (d *Device) Close() {
+	close(d.toMux)
+}
@@ -0,0 +1,19 @@
+package tundev
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metrSendErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tundev_send_errors",
+			Help: "Number of packets from the system that couldn't be sent through the multiplexer",
+		})
+	metrWriteDrops = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tundev_write_drops",
+			Help: "Number of packets for the system dropped because the interface couldn't keep up",
+		})
+)
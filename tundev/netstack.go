@@ -0,0 +1,184 @@
+//go:build netstack && !notun
+// +build netstack,!notun
+
+// This implementation runs a userspace TCP/IP stack instead of a TUN device, so
+// it needs no privileges.
+// Applications reach the tunnel through the SOCKS5 and HTTP proxies it exposes.
+package tundev
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/Jille/bindlink/packet"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+var (
+	mtu           = flag.Int("mtu", 1460, "MTU of the userspace network stack")
+	socksAddr     = flag.String("netstack_socks", "127.0.0.1:1080", "Serve a SOCKS5 proxy into the tunnel on this address (empty to disable)")
+	httpProxyAddr = flag.String("netstack_http_proxy", "127.0.0.1:3128", "Serve an HTTP proxy into the tunnel on this address (empty to disable)")
+	dnsServer     = flag.String("netstack_dns", "8.8.8.8:53", "DNS server used to resolve proxy requests, reached through the tunnel")
+)
+
+const nicID = 1
+
+type Device struct {
+	stack    *stack.Stack
+	ep       *channel.Endpoint
+	resolver *net.Resolver
+}
+
+func New(isMaster bool) (*Device, error) {
+	if isMaster {
+		return nil, errors.New("the netstack backend only works on the slave, the master needs a real TUN device")
+	}
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	ep := channel.New(512, uint32(*mtu), "")
+	if err := s.CreateNIC(nicID, ep); err != nil {
+		return nil, fmt.Errorf("CreateNIC: %v", err)
+	}
+	addr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4([4]byte{10, 10, 10, 2}).WithPrefix(),
+	}
+	if err := s.AddProtocolAddress(nicID, addr, stack.AddressProperties{}); err != nil {
+		return nil, fmt.Errorf("AddProtocolAddress: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+	d := &Device{
+		stack: s,
+		ep:    ep,
+	}
+	d.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial:     d.dialDNS,
+	}
+	if *socksAddr != "" {
+		l, err := net.Listen("tcp", *socksAddr)
+		if err != nil {
+			return nil, err
+		}
+		go d.serveSOCKS(l)
+	}
+	if *httpProxyAddr != "" {
+		l, err := net.Listen("tcp", *httpProxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		go d.serveHTTPProxy(l)
+	}
+	return d, nil
+}
+
+func (d *Device) Run(sendToMultiplexer func(*packet.Buffer) error) {
+	for {
+		pkt := d.ep.ReadContext(context.Background())
+		if pkt == nil {
+			log.Fatalf("Userspace network stack was closed")
+		}
+		p := copyPacket(pkt)
+		pkt.DecRef()
+		err := sendToMultiplexer(p)
+		p.Release()
+		if err != nil {
+			metrSendErrors.Inc()
+			log.Printf("Failed to send message through multiplexer: %v", err)
+		}
+	}
+}
+
+// copyPacket copies pkt into a pooled buffer.
+func copyPacket(pkt *stack.PacketBuffer) *packet.Buffer {
+	p := packet.Get(pkt.Size())
+	b := p.Bytes()
+	views, offset := pkt.AsViewList()
+	for v := views.Front(); v != nil && len(b) > 0; v = v.Next() {
+		s := v.AsSlice()
+		if offset >= len(s) {
+			offset -= len(s)
+			continue
+		}
+		b = b[copy(b, s[offset:]):]
+		offset = 0
+	}
+	return p
+}
+
+func (d *Device) Send(packet []byte) error {
+	if len(packet) == 0 || packet[0]>>4 != 4 {
+		return errors.New("netstack only handles IPv4 packets")
+	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(packet),
+	})
+	d.ep.InjectInbound(ipv4.ProtocolNumber, pkt)
+	pkt.DecRef()
+	return nil
+}
+
+func (d *Device) fullAddress(ctx context.Context, address string) (tcpip.FullAddress, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return tcpip.FullAddress{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return tcpip.FullAddress{}, fmt.Errorf("invalid port %q", portStr)
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		ips, err := d.resolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return tcpip.FullAddress{}, err
+		}
+		ip = ips[0].To4()
+	}
+	return tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.AddrFrom4Slice(ip),
+		Port: uint16(port),
+	}, nil
+}
+
+// dialContext opens a TCP connection through the tunnel.
+func (d *Device) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	addr, err := d.fullAddress(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return gonet.DialContextTCP(ctx, d.stack, addr, ipv4.ProtocolNumber)
+}
+
+// dialDNS always talks to --netstack_dns through the tunnel.
+func (d *Device) dialDNS(ctx context.Context, network, _ string) (net.Conn, error) {
+	addr, err := d.fullAddress(ctx, *dnsServer)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return gonet.DialContextTCP(ctx, d.stack, addr, ipv4.ProtocolNumber)
+	default:
+		return gonet.DialUDP(d.stack, nil, &addr, ipv4.ProtocolNumber)
+	}
+}
@@ -0,0 +1,217 @@
+//go:build netstack && !notun
+// +build netstack,!notun
+
+package tundev
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func (d *Device) serveSOCKS(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatalf("Failed to accept SOCKS connection on %s: %v", l.Addr(), err)
+		}
+		go func() {
+			if err := d.handleSOCKS(conn); err != nil {
+				log.Printf("SOCKS connection from %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// handleSOCKS implements the CONNECT command of SOCKS5 without authentication.
+func (d *Device) handleSOCKS(conn net.Conn) error {
+	defer conn.Close()
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != 5 {
+		return fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	// Only "no authentication"; the proxy listens on localhost.
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return err
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return err
+	}
+	var host string
+	switch req[3] {
+	case 1: // IPv4
+		var ip [4]byte
+		if _, err := io.ReadFull(conn, ip[:]); err != nil {
+			return err
+		}
+		host = net.IP(ip[:]).String()
+	case 3: // domain name
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return err
+		}
+		host = string(name)
+	case 4: // IPv6
+		var ip [16]byte
+		if _, err := io.ReadFull(conn, ip[:]); err != nil {
+			return err
+		}
+		host = net.IP(ip[:]).String()
+	default:
+		socksReply(conn, 8) // address type not supported
+		return fmt.Errorf("unsupported address type %d", req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return err
+	}
+	if req[1] != 1 {
+		socksReply(conn, 7) // command not supported
+		return fmt.Errorf("unsupported command %d", req[1])
+	}
+
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	remote, err := d.dialContext(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		socksReply(conn, 5) // connection refused
+		return fmt.Errorf("failed to connect to %s: %v", target, err)
+	}
+	if err := socksReply(conn, 0); err != nil {
+		remote.Close()
+		return err
+	}
+	pipe(conn, remote)
+	return nil
+}
+
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{5, status, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies both ways until both sides are done, then closes both.
+func pipe(a, b net.Conn) {
+	done := make(chan struct{})
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
+
+func (d *Device) serveHTTPProxy(l net.Listener) {
+	transport := &http.Transport{
+		DialContext: d.dialContext,
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodConnect {
+				d.handleHTTPConnect(w, r)
+			} else {
+				handleHTTPForward(transport, w, r)
+			}
+		}),
+	}
+	log.Fatalf("HTTP proxy on %s failed: %v", l.Addr(), srv.Serve(l))
+}
+
+func (d *Device) handleHTTPConnect(w http.ResponseWriter, r *http.Request) {
+	remote, err := d.dialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		remote.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		remote.Close()
+		log.Printf("HTTP proxy: failed to hijack connection: %v", err)
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		remote.Close()
+		conn.Close()
+		return
+	}
+	pipe(conn, remote)
+}
+
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func handleHTTPForward(transport http.RoundTripper, w http.ResponseWriter, r *http.Request) {
+	if !r.URL.IsAbs() {
+		http.Error(w, "this is a proxy, requests need an absolute URL", http.StatusBadRequest)
+		return
+	}
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	for _, h := range hopByHopHeaders {
+		out.Header.Del(h)
+	}
+	resp, err := transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, h := range hopByHopHeaders {
+		resp.Header.Del(h)
+	}
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,465 @@
+//go:build !notun && !netstack
+// +build !notun,!netstack
+
+package tundev
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"syscall"
+
+	"github.com/Jille/bindlink/packet"
+)
+
+// virtio_net_hdr from linux/virtio_net.h, in host (little endian) byte order.
+const (
+	virtioNetHdrLen = 10
+
+	virtioNetHdrFNeedsCsum = 1
+
+	virtioNetHdrGSONone  = 0
+	virtioNetHdrGSOTCPv4 = 1
+	virtioNetHdrGSOTCPv6 = 4
+
+	// maxCoalesceBatch is the most queued packets we merge at once.
+	maxCoalesceBatch = 64
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagCWR = 0x80
+)
+
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *virtioNetHdr) decode(b []byte) {
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.LittleEndian.Uint16(b[2:])
+	h.gsoSize = binary.LittleEndian.Uint16(b[4:])
+	h.csumStart = binary.LittleEndian.Uint16(b[6:])
+	h.csumOffset = binary.LittleEndian.Uint16(b[8:])
+}
+
+func (h *virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.LittleEndian.PutUint16(b[2:], h.hdrLen)
+	binary.LittleEndian.PutUint16(b[4:], h.gsoSize)
+	binary.LittleEndian.PutUint16(b[6:], h.csumStart)
+	binary.LittleEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+func checksumAdd(b []byte, sum uint64) uint64 {
+	for len(b) >= 2 {
+		sum += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint64) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+// pseudoHeaderSum returns the unfolded TCP pseudo header checksum of pkt.
+func pseudoHeaderSum(pkt []byte, tcpLen int) uint64 {
+	var sum uint64
+	if pkt[0]>>4 == 4 {
+		sum = checksumAdd(pkt[12:20], 0)
+	} else {
+		sum = checksumAdd(pkt[8:40], 0)
+	}
+	return sum + 6 + uint64(tcpLen)
+}
+
+func setIPv4Checksum(pkt []byte, ipHdrLen int) {
+	pkt[10], pkt[11] = 0, 0
+	binary.BigEndian.PutUint16(pkt[10:], ^checksumFold(checksumAdd(pkt[:ipHdrLen], 0)))
+}
+
+func setTCPChecksum(pkt []byte, ipHdrLen int) {
+	tcp := pkt[ipHdrLen:]
+	tcp[16], tcp[17] = 0, 0
+	binary.BigEndian.PutUint16(tcp[16:], ^checksumFold(checksumAdd(tcp, pseudoHeaderSum(pkt, len(tcp)))))
+}
+
+// tcpHeaderLen returns the length of the IP header and the offset of the TCP
+// payload, or ok=false if pkt isn't TCP.
+func tcpHeaderLen(pkt []byte) (ipHdrLen, hdrLen int, ok bool) {
+	if len(pkt) < 1 {
+		return 0, 0, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 || pkt[9] != 6 {
+			return 0, 0, false
+		}
+		ipHdrLen = int(pkt[0]&0xf) * 4
+	case 6:
+		if len(pkt) < 40 || pkt[6] != 6 {
+			return 0, 0, false
+		}
+		ipHdrLen = 40
+	default:
+		return 0, 0, false
+	}
+	if len(pkt) < ipHdrLen+20 {
+		return 0, 0, false
+	}
+	hdrLen = ipHdrLen + int(pkt[ipHdrLen+12]>>4)*4
+	if hdrLen < ipHdrLen+20 || len(pkt) < hdrLen {
+		return 0, 0, false
+	}
+	return ipHdrLen, hdrLen, true
+}
+
+// completeChecksum fills in the checksum if the kernel left that to us.
+func completeChecksum(h *virtioNetHdr, pkt []byte) error {
+	if h.flags&virtioNetHdrFNeedsCsum == 0 {
+		return nil
+	}
+	start := int(h.csumStart)
+	off := start + int(h.csumOffset)
+	if off+2 > len(pkt) {
+		return fmt.Errorf("checksum offset %d beyond packet of %d bytes", off, len(pkt))
+	}
+	binary.BigEndian.PutUint16(pkt[off:], ^checksumFold(checksumAdd(pkt[start:], 0)))
+	return nil
+}
+
+// splitGSO calls emit for every MTU sized packet in pkt, which has
+// virtio_net_hdr h. GSO packets that fit in mtu are passed on whole.
+func splitGSO(h *virtioNetHdr, pkt []byte, mtu int, emit func(*packet.Buffer) error) error {
+	if h.gsoType == virtioNetHdrGSONone || len(pkt) <= mtu {
+		if err := completeChecksum(h, pkt); err != nil {
+			return err
+		}
+		p := packet.FromBytes(pkt)
+		err := emit(p)
+		p.Release()
+		return err
+	}
+	if h.gsoType != virtioNetHdrGSOTCPv4 && h.gsoType != virtioNetHdrGSOTCPv6 {
+		return fmt.Errorf("unsupported GSO type %d", h.gsoType)
+	}
+	ipHdrLen, hdrLen, ok := tcpHeaderLen(pkt)
+	if !ok {
+		return fmt.Errorf("GSO packet isn't TCP")
+	}
+	mss := int(h.gsoSize)
+	if mss == 0 {
+		return fmt.Errorf("GSO packet with gso_size 0")
+	}
+	isV4 := pkt[0]>>4 == 4
+	firstSeq := binary.BigEndian.Uint32(pkt[ipHdrLen+4:])
+	firstID := binary.BigEndian.Uint16(pkt[4:])
+	flags := pkt[ipHdrLen+13]
+	payload := pkt[hdrLen:]
+	for i := 0; len(payload) > 0; i++ {
+		n := mss
+		if n > len(payload) {
+			n = len(payload)
+		}
+		p := packet.Get(hdrLen + n)
+		seg := p.Bytes()
+		copy(seg, pkt[:hdrLen])
+		copy(seg[hdrLen:], payload[:n])
+		payload = payload[n:]
+
+		segFlags := flags
+		if len(payload) > 0 {
+			segFlags &^= tcpFlagFIN | tcpFlagPSH
+		}
+		if i > 0 {
+			segFlags &^= tcpFlagCWR
+		}
+		seg[ipHdrLen+13] = segFlags
+		binary.BigEndian.PutUint32(seg[ipHdrLen+4:], firstSeq+uint32(i*mss))
+		if isV4 {
+			binary.BigEndian.PutUint16(seg[2:], uint16(len(seg)))
+			binary.BigEndian.PutUint16(seg[4:], firstID+uint16(i))
+			setIPv4Checksum(seg, ipHdrLen)
+		} else {
+			binary.BigEndian.PutUint16(seg[4:], uint16(len(seg)-ipHdrLen))
+		}
+		setTCPChecksum(seg, ipHdrLen)
+		err := emit(p)
+		p.Release()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readOffloadQueue reads packets from q into pooled buffers and passes them on.
+func readOffloadQueue(q *os.File, name string, sendToMultiplexer func(*packet.Buffer) error) {
+	var hdr [virtioNetHdrLen]byte
+	iovs := make([]syscall.Iovec, 3)
+	overflow := make([]byte, 65535)
+	large := make([]byte, 65535)
+	for {
+		p := packet.Get(packet.PooledSize)
+		n, err := readv(q, iovs, hdr[:], p.Bytes(), overflow)
+		if err != nil {
+			log.Fatalf("Failed to read from interface %s: %v", name, err)
+		}
+		if err := handleOffloadRead(hdr[:], n, p, overflow, large, *mtu, sendToMultiplexer); err != nil {
+			metrSendErrors.Inc()
+			log.Printf("Dropping packet from %s: %v", name, err)
+		}
+		p.Release()
+	}
+}
+
+// handleOffloadRead handles an n byte read into hdr, p and overflow.
+func handleOffloadRead(hdr []byte, n int, p *packet.Buffer, overflow, large []byte, mtu int, emit func(*packet.Buffer) error) error {
+	if n < virtioNetHdrLen {
+		return fmt.Errorf("short read of %d bytes", n)
+	}
+	var h virtioNetHdr
+	h.decode(hdr)
+	n -= virtioNetHdrLen
+	if n > p.Len() {
+		pkt := append(append(large[:0], p.Bytes()...), overflow[:n-p.Len()]...)
+		return splitGSO(&h, pkt, mtu, emit)
+	}
+	p.Truncate(n)
+	if h.gsoType != virtioNetHdrGSONone && n > mtu {
+		return splitGSO(&h, p.Bytes(), mtu, emit)
+	}
+	if err := completeChecksum(&h, p.Bytes()); err != nil {
+		return err
+	}
+	return emit(p)
+}
+
+// offloadWriter coalesces consecutive segments of a TCP stream into GSO writes.
+// Packets are spread over the queues by address, so a stream isn't reordered.
+type offloadWriter struct {
+	packets []chan []byte
+}
+
+func newOffloadWriter(queues []io.ReadWriteCloser, name string) *offloadWriter {
+	w := &offloadWriter{}
+	for _, q := range queues {
+		ch := make(chan []byte, 1024)
+		w.packets = append(w.packets, ch)
+		go w.run(ch, q, name)
+	}
+	return w
+}
+
+func (w *offloadWriter) enqueue(packet []byte) {
+	buf := make([]byte, virtioNetHdrLen+len(packet))
+	copy(buf[virtioNetHdrLen:], packet)
+	ch := w.packets[0]
+	if len(w.packets) > 1 {
+		var addrs []byte
+		if len(packet) >= 20 && packet[0]>>4 == 4 {
+			addrs = packet[12:20]
+		} else if len(packet) >= 40 && packet[0]>>4 == 6 {
+			addrs = packet[8:40]
+		}
+		ch = w.packets[checksumFold(checksumAdd(addrs, 0))%uint16(len(w.packets))]
+	}
+	select {
+	case ch <- buf:
+	default:
+		// The interface can't keep up, drop the packet like a full queue would.
+		metrWriteDrops.Inc()
+	}
+}
+
+func (w *offloadWriter) run(packets chan []byte, q io.Writer, name string) {
+	batch := make([][]byte, 0, maxCoalesceBatch)
+	for {
+		batch = append(batch[:0], <-packets)
+	drain:
+		for len(batch) < maxCoalesceBatch {
+			select {
+			case p := <-packets:
+				batch = append(batch, p)
+			default:
+				break drain
+			}
+		}
+		for _, b := range coalesce(batch) {
+			if _, err := q.Write(b); err != nil {
+				log.Printf("Failed to write to interface %s: %v", name, err)
+			}
+		}
+	}
+}
+
+// gsoGroup is a run of TCP segments being merged.
+type gsoGroup struct {
+	first    []byte
+	buf      []byte
+	ipHdrLen int
+	hdrLen   int
+	gsoSize  int
+	nextSeq  uint32
+	count    int
+	closed   bool
+}
+
+// coalescable returns whether pkt is a plain TCP data segment with a valid
+// checksum.
+func coalescable(pkt []byte) (ipHdrLen, hdrLen int, ok bool) {
+	ipHdrLen, hdrLen, ok = tcpHeaderLen(pkt)
+	if !ok || len(pkt) == hdrLen {
+		return 0, 0, false
+	}
+	if pkt[0]>>4 == 4 {
+		if ipHdrLen != 20 || int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) || binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+			return 0, 0, false
+		}
+	} else if int(binary.BigEndian.Uint16(pkt[4:]))+40 != len(pkt) {
+		return 0, 0, false
+	}
+	if f := pkt[ipHdrLen+13]; f != tcpFlagACK && f != tcpFlagACK|tcpFlagPSH {
+		return 0, 0, false
+	}
+	if checksumFold(checksumAdd(pkt[ipHdrLen:], pseudoHeaderSum(pkt, len(pkt)-ipHdrLen))) != 0xffff {
+		return 0, 0, false
+	}
+	return ipHdrLen, hdrLen, true
+}
+
+func (g *gsoGroup) sameFlow(pkt []byte, ipHdrLen, hdrLen int) bool {
+	a, b := g.first, pkt
+	if a[0]>>4 != b[0]>>4 || hdrLen != g.hdrLen || ipHdrLen != g.ipHdrLen {
+		return false
+	}
+	if a[0]>>4 == 4 {
+		// TOS, TTL and addresses.
+		if a[1] != b[1] || a[8] != b[8] || string(a[12:20]) != string(b[12:20]) {
+			return false
+		}
+	} else {
+		// Traffic class, flow label, hop limit and addresses.
+		if string(a[:4]) != string(b[:4]) || a[7] != b[7] || string(a[8:40]) != string(b[8:40]) {
+			return false
+		}
+	}
+	// Ports, ack, window and options have to match.
+	ta, tb := a[ipHdrLen:hdrLen], b[ipHdrLen:hdrLen]
+	return string(ta[0:4]) == string(tb[0:4]) && string(ta[8:12]) == string(tb[8:12]) && string(ta[14:16]) == string(tb[14:16]) && string(ta[20:]) == string(tb[20:])
+}
+
+func (g *gsoGroup) tryAppend(pkt []byte, ipHdrLen, hdrLen int) bool {
+	if g.closed || !g.sameFlow(pkt, ipHdrLen, hdrLen) {
+		return false
+	}
+	payload := pkt[hdrLen:]
+	if binary.BigEndian.Uint32(pkt[ipHdrLen+4:]) != g.nextSeq || len(payload) > g.gsoSize || len(g.buf)-virtioNetHdrLen+len(payload) > 65535 {
+		return false
+	}
+	if g.count == 1 {
+		g.buf = append(make([]byte, 0, virtioNetHdrLen+65535), make([]byte, virtioNetHdrLen)...)
+		g.buf = append(g.buf, g.first...)
+	}
+	g.buf = append(g.buf, payload...)
+	g.nextSeq += uint32(len(payload))
+	g.count++
+	if pkt[ipHdrLen+13]&tcpFlagPSH != 0 {
+		g.buf[virtioNetHdrLen+ipHdrLen+13] |= tcpFlagPSH
+		g.closed = true
+	}
+	if len(payload) < g.gsoSize {
+		g.closed = true
+	}
+	return true
+}
+
+// finish returns the buffer to write, including its virtio_net_hdr.
+func (g *gsoGroup) finish() []byte {
+	if g.count == 1 {
+		return g.buf
+	}
+	pkt := g.buf[virtioNetHdrLen:]
+	h := virtioNetHdr{
+		flags:      virtioNetHdrFNeedsCsum,
+		hdrLen:     uint16(g.hdrLen),
+		gsoSize:    uint16(g.gsoSize),
+		csumStart:  uint16(g.ipHdrLen),
+		csumOffset: 16,
+	}
+	if pkt[0]>>4 == 4 {
+		h.gsoType = virtioNetHdrGSOTCPv4
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		setIPv4Checksum(pkt, g.ipHdrLen)
+	} else {
+		h.gsoType = virtioNetHdrGSOTCPv6
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-g.ipHdrLen))
+	}
+	h.encode(g.buf)
+	// NEEDS_CSUM wants the pseudo header checksum in place.
+	binary.BigEndian.PutUint16(pkt[g.ipHdrLen+16:], checksumFold(pseudoHeaderSum(pkt, len(pkt)-g.ipHdrLen)))
+	return g.buf
+}
+
+// coalesce merges consecutive TCP segments in batch. Entries and results have
+// virtioNetHdrLen bytes of zeroed headroom.
+func coalesce(batch [][]byte) [][]byte {
+	var ret [][]byte
+	var groups []*gsoGroup
+	for _, b := range batch {
+		pkt := b[virtioNetHdrLen:]
+		ipHdrLen, hdrLen, ok := coalescable(pkt)
+		if !ok {
+			// Flush what we have so far to keep packets in order.
+			for _, g := range groups {
+				ret = append(ret, g.finish())
+			}
+			groups = groups[:0]
+			ret = append(ret, b)
+			continue
+		}
+		merged := false
+		for _, g := range groups {
+			if g.tryAppend(pkt, ipHdrLen, hdrLen) {
+				merged = true
+				break
+			}
+		}
+		if merged {
+			continue
+		}
+		groups = append(groups, &gsoGroup{
+			first:    pkt,
+			buf:      b,
+			ipHdrLen: ipHdrLen,
+			hdrLen:   hdrLen,
+			gsoSize:  len(pkt) - hdrLen,
+			nextSeq:  binary.BigEndian.Uint32(pkt[ipHdrLen+4:]) + uint32(len(pkt)-hdrLen),
+			count:    1,
+		})
+	}
+	for _, g := range groups {
+		ret = append(ret, g.finish())
+	}
+	return ret
+}
@@ -0,0 +1,68 @@
+//go:build !notun && !netstack
+// +build !notun,!netstack
+
+package tundev
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tunFCsum = 0x01
+	tunFTSO4 = 0x02
+	tunFTSO6 = 0x04
+)
+
+type ifReq struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	pad   [40 - syscall.IFNAMSIZ - 2]byte
+}
+
+func ioctl(fd uintptr, request uintptr, argp uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, argp); errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
+
+// openOffloadQueue opens a TUN queue with IFF_VNET_HDR and TSO enabled.
+func openOffloadQueue(name string, multiQueue bool) (*os.File, string, error) {
+	f, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	var req ifReq
+	req.Flags = syscall.IFF_TUN | syscall.IFF_NO_PI | syscall.IFF_VNET_HDR
+	if multiQueue {
+		req.Flags |= 0x100 // IFF_MULTI_QUEUE
+	}
+	copy(req.Name[:], name)
+	if err := ioctl(f.Fd(), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&req))); err != nil {
+		f.Close()
+		return nil, "", fmt.Errorf("TUNSETIFF: %v", err)
+	}
+	if err := ioctl(f.Fd(), syscall.TUNSETOFFLOAD, tunFCsum|tunFTSO4|tunFTSO6); err != nil {
+		f.Close()
+		return nil, "", fmt.Errorf("TUNSETOFFLOAD: %v", err)
+	}
+	return f, strings.TrimRight(string(req.Name[:]), "\x00"), nil
+}
+
+// readv reads a packet from f into bufs. iovs needs an entry per buffer.
+func readv(f *os.File, iovs []syscall.Iovec, bufs ...[]byte) (int, error) {
+	iovs = iovs[:len(bufs)]
+	for i, b := range bufs {
+		iovs[i].Base = &b[0]
+		iovs[i].SetLen(len(b))
+	}
+	n, _, errno := syscall.Syscall(syscall.SYS_READV, f.Fd(), uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)))
+	if errno != 0 {
+		return 0, os.NewSyscallError("readv", errno)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,18 @@
+//go:build !notun && !netstack && !linux
+// +build !notun,!netstack,!linux
+
+package tundev
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func openOffloadQueue(name string, multiQueue bool) (*os.File, string, error) {
+	return nil, "", errors.New("--tun_offload is only supported on Linux")
+}
+
+func readv(f *os.File, iovs []syscall.Iovec, bufs ...[]byte) (int, error) {
+	return 0, errors.New("--tun_offload is only supported on Linux")
+}
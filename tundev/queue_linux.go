@@ -0,0 +1,18 @@
+//go:build !notun && !netstack
+// +build !notun,!netstack
+
+package tundev
+
+import (
+	"github.com/songgao/water"
+)
+
+func queueConfig(name string, multiQueue bool) water.Config {
+	return water.Config{
+		DeviceType: water.TUN,
+		PlatformSpecificParams: water.PlatformSpecificParams{
+			Name:       name,
+			MultiQueue: multiQueue,
+		},
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !notun && !netstack && !linux
+// +build !notun,!netstack,!linux
+
+package tundev
+
+import (
+	"log"
+
+	"github.com/songgao/water"
+)
+
+func queueConfig(name string, multiQueue bool) water.Config {
+	if multiQueue {
+		log.Fatalf("--tun_queues > 1 is only supported on Linux")
+	}
+	return water.Config{
+		DeviceType: water.TUN,
+	}
+}
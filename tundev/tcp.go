@@ -1,44 +1,288 @@
+//go:build notun
 // +build notun
 
 // This is a fake implementation that just tunnels TCP rather than a full interface.
 package tundev
 
 import (
+	"errors"
 	"flag"
+	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/Jille/bindlink/packet"
 )
 
 var (
 	connectTcp = flag.String("connect_tcp", "", "Connect to this host:port and multiplex all received traffic over the tunnel")
+	listenTcp  = flag.String("listen_tcp", "", "Accept a single connection on this address and multiplex its traffic over the tunnel")
 )
 
 type Device struct {
-	conn net.Conn
+	mtx      sync.Mutex
+	window   *sync.Cond
+	queued   *sync.Cond
+	conn     net.Conn
+	listener net.Listener
+	out      chan *packet.Buffer
+
+	// Sending side
+	nextSeq uint32
+	unacked []*frame
+
+	// Receiving side
+	expectedSeq uint32
+	outOfOrder  map[uint32]*frame
+	// toConn is in-order data for conn. A nil payload ends the stream.
+	toConn [][]byte
+	// Frames received since our last ack, and whether a delayed ack is pending.
+	unackedFrames int
+	ackScheduled  bool
 }
 
 func New(isMaster bool) (*Device, error) {
-	conn, err := net.Dial("tcp", *connectTcp)
-	if err != nil {
-		return nil, err
+	d := &Device{
+		out:        make(chan *packet.Buffer, 1024),
+		outOfOrder: map[uint32]*frame{},
+	}
+	d.window = sync.NewCond(&d.mtx)
+	d.queued = sync.NewCond(&d.mtx)
+	switch {
+	case *connectTcp != "" && *listenTcp != "":
+		return nil, errors.New("--connect_tcp and --listen_tcp are mutually exclusive")
+	case *connectTcp != "":
+		conn, err := net.Dial("tcp", *connectTcp)
+		if err != nil {
+			return nil, err
+		}
+		d.conn = conn
+	case *listenTcp != "":
+		l, err := net.Listen("tcp", *listenTcp)
+		if err != nil {
+			return nil, err
+		}
+		d.listener = l
+	default:
+		return nil, errors.New("one of --connect_tcp or --listen_tcp is required")
 	}
-	return &Device{conn}, nil
+	return d, nil
 }
 
-func (d *Device) Run(sendToMultiplexer func([]byte) error) {
-	buf := make([]byte, 2000)
+func (d *Device) Run(sendToMultiplexer func(*packet.Buffer) error) {
+	go func() {
+		for p := range d.out {
+			err := sendToMultiplexer(p)
+			p.Release()
+			if err != nil {
+				metrSendErrors.Inc()
+				log.Printf("Failed to send message through multiplexer: %v", err)
+			}
+		}
+	}()
+	go d.retransmitLoop()
+	go d.writeLoop()
+
+	if d.listener != nil {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			log.Fatalf("Failed to accept on %q: %v", *listenTcp, err)
+		}
+		d.listener.Close()
+		d.mtx.Lock()
+		d.conn = conn
+		d.queued.Broadcast()
+		d.mtx.Unlock()
+	}
+
 	for {
-		n, err := d.conn.Read(buf)
+		// Read straight into the frame, leaving room for its header.
+		p := packet.Get(frameHeaderLen + maxFramePayload)
+		n, err := d.conn.Read(p.Bytes()[frameHeaderLen:])
+		if err == io.EOF {
+			p.Truncate(frameHeaderLen)
+			d.queueFrame(frameFin, p)
+			return
+		}
 		if err != nil {
-			log.Fatalf("Failed to read from TCP %q: %v", *connectTcp, err)
+			log.Fatalf("Failed to read from TCP %s: %v", d.conn.RemoteAddr(), err)
 		}
-		if err := sendToMultiplexer(buf[:n]); err != nil {
-			log.Fatalf("Failed to send message through multiplexer: %v", err)
+		if n == 0 {
+			p.Release()
+			continue
 		}
+		p.Truncate(frameHeaderLen + n)
+		d.queueFrame(frameData, p)
 	}
 }
 
+// queueFrame sends a frame, blocking while the window is full. It takes over
+// the caller's reference to p.
+func (d *Device) queueFrame(typ byte, p *packet.Buffer) {
+	d.mtx.Lock()
+	for len(d.unacked) >= sendWindow {
+		d.window.Wait()
+	}
+	f := newFrame(typ, d.nextSeq, p)
+	d.nextSeq++
+	f.sentAt = time.Now()
+	f.rto = retransmitTimeout
+	d.unacked = append(d.unacked, f)
+	// One reference stays with the frame until it's acked.
+	p.Retain()
+	d.mtx.Unlock()
+	d.out <- p
+}
+
+func (d *Device) retransmitLoop() {
+	for {
+		time.Sleep(retransmitTimeout / 5)
+		var resend []*packet.Buffer
+		d.mtx.Lock()
+		now := time.Now()
+		for _, f := range d.unacked {
+			if now.Sub(f.sentAt) > f.rto {
+				f.sentAt = now
+				f.rto = min(2*f.rto, maxRetransmitTimeout)
+				f.buf.Retain()
+				resend = append(resend, f.buf)
+			}
+		}
+		d.mtx.Unlock()
+		for _, b := range resend {
+			d.out <- b
+		}
+	}
+}
+
+// Send handles a frame received from the tunnel.
 func (d *Device) Send(packet []byte) error {
-	_, err := d.conn.Write(packet)
-	return err
+	f, err := decodeFrame(packet)
+	if err != nil {
+		return err
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if f.typ == frameAck {
+		d.handleAck(f.seq)
+		return nil
+	}
+	// Sequence numbers are compared with wrap-around in mind.
+	switch diff := int32(f.seq - d.expectedSeq); {
+	case diff < 0:
+		// Duplicate, our previous ack was probably lost.
+		d.sendAck()
+		return nil
+	case len(d.toConn) >= sendWindow:
+		// The TCP connection can't keep up. The frame will be retransmitted.
+		return nil
+	case diff == 0:
+		d.receiveInOrder(f)
+		for {
+			next, ok := d.outOfOrder[d.expectedSeq]
+			if !ok {
+				break
+			}
+			delete(d.outOfOrder, d.expectedSeq)
+			d.receiveInOrder(next)
+		}
+	case diff < 2*sendWindow:
+		if _, ok := d.outOfOrder[f.seq]; !ok {
+			f.payload = append([]byte(nil), f.payload...)
+			d.outOfOrder[f.seq] = f
+		}
+	default:
+		log.Printf("Dropping frame %d, too far ahead of %d", f.seq, d.expectedSeq)
+	}
+	d.scheduleAck()
+	return nil
+}
+
+func (d *Device) handleAck(seq uint32) {
+	n := 0
+	for n < len(d.unacked) && int32(seq-d.unacked[n].seq) > 0 {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	for i, f := range d.unacked[:n] {
+		f.buf.Release()
+		d.unacked[i] = nil
+	}
+	d.unacked = d.unacked[n:]
+	d.window.Broadcast()
+}
+
+// scheduleAck acks now after ackEvery frames, or after ackDelay otherwise.
+func (d *Device) scheduleAck() {
+	d.unackedFrames++
+	if d.unackedFrames >= ackEvery {
+		d.sendAck()
+		return
+	}
+	if d.ackScheduled {
+		return
+	}
+	d.ackScheduled = true
+	time.AfterFunc(ackDelay, func() {
+		d.mtx.Lock()
+		defer d.mtx.Unlock()
+		d.ackScheduled = false
+		if d.unackedFrames > 0 {
+			d.sendAck()
+		}
+	})
+}
+
+func (d *Device) sendAck() {
+	d.unackedFrames = 0
+	p := packet.Get(frameHeaderLen)
+	newFrame(frameAck, d.expectedSeq, p)
+	select {
+	case d.out <- p:
+	default:
+		// Acks are cumulative, the next one will cover this.
+		p.Release()
+	}
+}
+
+func (d *Device) receiveInOrder(f *frame) {
+	d.expectedSeq++
+	if f.typ == frameFin {
+		d.toConn = append(d.toConn, nil)
+	} else {
+		d.toConn = append(d.toConn, append([]byte{}, f.payload...))
+	}
+	d.queued.Signal()
+}
+
+// writeLoop writes to conn without holding d.mtx, so a slow peer doesn't hold
+// up acks.
+func (d *Device) writeLoop() {
+	for {
+		d.mtx.Lock()
+		for d.conn == nil || len(d.toConn) == 0 {
+			d.queued.Wait()
+		}
+		conn := d.conn
+		payloads := d.toConn
+		d.toConn = nil
+		d.mtx.Unlock()
+		for _, p := range payloads {
+			if p == nil {
+				if tc, ok := conn.(*net.TCPConn); ok {
+					tc.CloseWrite()
+				} else {
+					conn.Close()
+				}
+				return
+			}
+			if _, err := conn.Write(p); err != nil {
+				log.Fatalf("Failed to write to TCP %s: %v", conn.RemoteAddr(), err)
+			}
+		}
+	}
 }
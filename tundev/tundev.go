@@ -1,26 +1,35 @@
-// +build !notun
+//go:build !notun && !netstack
+// +build !notun,!netstack
 
 package tundev
 
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"runtime"
 	"strconv"
+	"sync/atomic"
 	"syscall"
 
+	"github.com/Jille/bindlink/packet"
 	"github.com/songgao/water"
 )
 
 var (
-	mtu = flag.Int("mtu", 1460, "MTU to use for tundev")
+	mtu     = flag.Int("mtu", 1460, "MTU to use for tundev")
+	queues  = flag.Int("tun_queues", 1, "Number of TUN queues to open (Linux multiqueue); each gets its own reader goroutine")
+	offload = flag.Bool("tun_offload", false, "Enable TSO/GRO on the TUN device using virtio-net headers (Linux only)")
 )
 
 type Device struct {
-	ifce *water.Interface
+	name      string
+	queues    []io.ReadWriteCloser
+	nextQueue uint32
+	offload   *offloadWriter
 }
 
 func New(isMaster bool) (*Device, error) {
@@ -28,18 +37,38 @@ func New(isMaster bool) (*Device, error) {
 		true:  "10.10.10.1",
 		false: "10.10.10.2",
 	}
-	ifce, err := water.New(water.Config{
-		DeviceType: water.TUN,
-	})
-	if err != nil {
-		return nil, err
+	if *queues < 1 {
+		return nil, fmt.Errorf("--tun_queues should be at least 1, was %d", *queues)
 	}
-	log.Printf("Interface name: %s", ifce.Name())
+	d := &Device{}
+	for i := 0; i < *queues; i++ {
+		var q io.ReadWriteCloser
+		if *offload {
+			f, name, err := openOffloadQueue(d.name, *queues > 1)
+			if err != nil {
+				return nil, err
+			}
+			q = f
+			d.name = name
+		} else {
+			ifce, err := water.New(queueConfig(d.name, *queues > 1))
+			if err != nil {
+				return nil, err
+			}
+			q = ifce
+			d.name = ifce.Name()
+		}
+		if err := setBlocking(q); err != nil {
+			return nil, err
+		}
+		d.queues = append(d.queues, q)
+	}
+	log.Printf("Interface name: %s", d.name)
 	var c *exec.Cmd
 	if runtime.GOOS == "darwin" {
 		c = exec.Command(
 			"ifconfig",
-			ifce.Name(),
+			d.name,
 			ips[isMaster],
 			ips[!isMaster],
 			"mtu",
@@ -48,7 +77,7 @@ func New(isMaster bool) (*Device, error) {
 	} else {
 		c = exec.Command(
 			"ifconfig",
-			ifce.Name(),
+			d.name,
 			ips[isMaster],
 			"netmask",
 			"255.255.255.252",
@@ -59,30 +88,65 @@ func New(isMaster bool) (*Device, error) {
 	if out, err := c.CombinedOutput(); err != nil {
 		return nil, fmt.Errorf("%s: %s", err, out)
 	}
-	if f, ok := ifce.ReadWriteCloser.(*os.File); ok {
+	if *offload {
+		d.offload = newOffloadWriter(d.queues, d.name)
+	}
+	return d, nil
+}
+
+func setBlocking(q io.ReadWriteCloser) error {
+	if ifce, ok := q.(*water.Interface); ok {
+		q = ifce.ReadWriteCloser
+	}
+	if f, ok := q.(*os.File); ok {
 		if err := syscall.SetNonblock(int(f.Fd()), false); err != nil {
-			return nil, fmt.Errorf("Failed to set blocking mode: %v", err)
+			return fmt.Errorf("Failed to set blocking mode: %v", err)
 		}
 	} else {
 		log.Printf("Couldn't cast to os.File. Might crash with EAGAIN.")
 	}
-	return &Device{ifce}, nil
+	return nil
 }
 
-func (d *Device) Run(sendToMultiplexer func([]byte) error) {
-	buf := make([]byte, 2000)
+// Run reads all queues in parallel, so sendToMultiplexer must be safe for
+// concurrent use.
+func (d *Device) Run(sendToMultiplexer func(*packet.Buffer) error) {
+	for _, q := range d.queues[1:] {
+		go d.readQueue(q, sendToMultiplexer)
+	}
+	d.readQueue(d.queues[0], sendToMultiplexer)
+}
+
+func (d *Device) readQueue(q io.Reader, sendToMultiplexer func(*packet.Buffer) error) {
+	if d.offload != nil {
+		readOffloadQueue(q.(*os.File), d.name, sendToMultiplexer)
+		return
+	}
 	for {
-		n, err := d.ifce.Read(buf)
+		p := packet.Get(2000)
+		n, err := q.Read(p.Bytes())
 		if err != nil {
-			log.Fatalf("Failed to read from interface %s: %v", d.ifce.Name(), err)
+			log.Fatalf("Failed to read from interface %s: %v", d.name, err)
 		}
-		if err := sendToMultiplexer(buf[:n]); err != nil {
-			log.Fatalf("Failed to send message through multiplexer: %v", err)
+		p.Truncate(n)
+		err = sendToMultiplexer(p)
+		p.Release()
+		if err != nil {
+			metrSendErrors.Inc()
+			log.Printf("Failed to send message through multiplexer: %v", err)
 		}
 	}
 }
 
 func (d *Device) Send(packet []byte) error {
-	_, err := d.ifce.Write(packet)
+	if d.offload != nil {
+		d.offload.enqueue(packet)
+		return nil
+	}
+	q := d.queues[0]
+	if len(d.queues) > 1 {
+		q = d.queues[atomic.AddUint32(&d.nextQueue, 1)%uint32(len(d.queues))]
+	}
+	_, err := q.Write(packet)
 	return err
 }